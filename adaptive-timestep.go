@@ -0,0 +1,41 @@
+/*
+	stores the adaptive time step: the length of every step follows the shortest time scale among the stars
+*/
+
+package main
+
+import "math"
+
+// TimeScale is the time over which s moves appreciably under its stored acceleration a, given its velocity v:
+//
+//	min(|v| / |a|, sqrt(epsilon / |a|))
+//
+// where epsilon is the softening length. The first criterion is skipped for stars at rest and the second one
+// without softening; it is +Inf for a star without acceleration or without any criterion.
+func (s *Star) TimeScale(softening Softening) float64 {
+	a := math.Hypot(s.acceleration.x, s.acceleration.y)
+	scale := math.Inf(1)
+	if a == 0 {
+		return scale
+	}
+	if v := math.Hypot(s.velocity.x, s.velocity.y); v > 0 {
+		scale = v / a
+	}
+	if softening.kind != NoSoftening && softening.epsilon > 0 {
+		scale = math.Min(scale, math.Sqrt(softening.epsilon/a))
+	}
+	return scale
+}
+
+// StepSize returns the length of the next step of u. Without a tolerance it is the fixed time step; otherwise it is
+// tolerance times the shortest time scale of the stars of u, but never more than the time step.
+func (settings *Settings) StepSize(u *Universe) float64 {
+	if settings.tolerance <= 0 {
+		return settings.time
+	}
+	dt := settings.time
+	for _, s := range u.stars {
+		dt = math.Min(dt, settings.tolerance*s.TimeScale(settings.softening))
+	}
+	return dt
+}
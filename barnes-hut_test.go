@@ -1,8 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"gifhelper"
+	"math"
+	"math/rand"
+	"os"
+	"strings"
 	"testing"
 )
 
@@ -49,7 +54,7 @@ func TestJupiterSimulation(t *testing.T) {
 }
 
 func TestGalaxySimulation(t *testing.T) {
-	// g0 := InitializeGalaxy(500, 4e21, 7e22, 2e22)
+	// g0 := InitializeGalaxy(NewRand(1), 500, 4e21, 7e22, 2e22)
 	// width := 1.0e23
 	// galaxies := []Galaxy{g0}
 	// initialUniverse := InitializeUniverse(galaxies, width)
@@ -76,8 +81,9 @@ func TestCollisionSimulation(t *testing.T) {
 	// all units are in SI (meters, kg, etc.)
 	// but feel free to change the positions of the galaxies.
 
-	g0 := InitializeGalaxy(500, 4e21, 4e22, 3e22)
-	g1 := InitializeGalaxy(500, 4e21, 3e22, 3e22)
+	rng := NewRand(1)
+	g0 := InitializeGalaxy(rng, 500, 4e21, 4e22, 3e22)
+	g1 := InitializeGalaxy(rng, 500, 4e21, 3e22, 3e22)
 
 	// you probably want to apply a "push" function at this point to these galaxies to move
 	// them toward each other to collide.
@@ -94,7 +100,7 @@ func TestCollisionSimulation(t *testing.T) {
 	initialUniverse := InitializeUniverse(galaxies, width)
 
 	// now evolve the universe: feel free to adjust the following parameters.
-	// There is a maximum number of steps we can simulate the collision. If we reach a point where two black holes have collided with eacher, their position will be the same, and the quadtree will be stuck in an infinite loop trying to allocate them into the right places. The tree will grow indefinitely because no matter how we divide the quadrants, these two black holes will always end up in the same quadrant.
+	// When the two black holes collide their positions become the same and no amount of dividing quadrants separates them. The quad tree stops at settings.maxDepth and keeps such stars together in a bucket (or merges them, see MergeCoincident), so the run can go on as long as we like.
 	numGens := 10000
 	time := 3e15
 	theta := 0.5
@@ -142,3 +148,1500 @@ func CreateCustomUniverse() *Universe {
 
 	return &customUniverse
 }
+
+func TestIntegratorsCircularOrbit(t *testing.T) {
+	integrators := map[string]Integrator{
+		"leapfrog": Leapfrog{},
+		"verlet":   VelocityVerlet{},
+		"rk4":      RK4{},
+	}
+	for name, integrator := range integrators {
+		u := CreateCircularOrbit()
+		r0 := Dist(u.stars[0], u.stars[1])
+		period := 2 * math.Pi * r0 / u.stars[1].velocity.y
+
+		settings := DefaultSettings(period/2000, 0.5)
+		settings.integrator = integrator
+		timePoints, err := BarnesHutWithSettings(u, 2000, settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		last := timePoints[len(timePoints)-1]
+		r := Dist(last.stars[0], last.stars[1])
+		if math.Abs(r-r0)/r0 > 1e-3 {
+			t.Errorf("%s: orbital radius drifted from %v to %v after one period", name, r0, r)
+		}
+	}
+}
+
+// CreateCircularOrbit returns a light star on a circular orbit around a heavy one
+func CreateCircularOrbit() *Universe {
+	var sun, planet Star
+	sun.mass = 1e30
+	planet.mass = 1
+	sun.position = OrderedPair{5e11, 5e11}
+	planet.position = OrderedPair{6e11, 5e11}
+	planet.velocity.y = math.Sqrt(G * sun.mass / 1e11)
+
+	var u Universe
+	u.width = 1e12
+	u.AddStar(sun)
+	u.AddStar(planet)
+	return &u
+}
+
+func TestSofteningKernel(t *testing.T) {
+	var a, b Star
+	a.mass, b.mass = 1, 1
+	b.position.x = 1e-3
+
+	plummer := Softening{kind: PlummerSoftening, epsilon: 1}
+	spline := Softening{kind: SplineSoftening, epsilon: 1}
+
+	// close encounters stay finite and bounded by the kernel at the origin
+	F := ComputeGravityForce(&a, &b, plummer)
+	if F.x <= 0 || F.x > G*1e-3 {
+		t.Errorf("plummer force at small distance is %v", F.x)
+	}
+	F = ComputeGravityForce(&a, &b, spline)
+	if F.x <= 0 || math.IsInf(F.x, 0) || math.IsNaN(F.x) {
+		t.Errorf("spline force at small distance is %v", F.x)
+	}
+
+	// the spline kernel is exactly Newtonian beyond its support
+	b.position.x = 3
+	newton := ComputeGravityForce(&a, &b, Softening{})
+	F = ComputeGravityForce(&a, &b, spline)
+	if math.Abs(F.x-newton.x)/newton.x > 1e-12 {
+		t.Errorf("spline force %v differs from Newtonian force %v outside 2.8 epsilon", F.x, newton.x)
+	}
+
+	// and continuous at the edge of the support
+	inside := spline.Kernel(2.8 - 1e-9)
+	outside := spline.Kernel(2.8 + 1e-9)
+	if math.Abs(inside-outside)/outside > 1e-6 {
+		t.Errorf("spline kernel jumps from %v to %v at its support", inside, outside)
+	}
+}
+
+func TestCoincidentStars(t *testing.T) {
+	var a, b, c Star
+	a.mass, b.mass, c.mass = 1e30, 2e30, 1e30
+	a.position = OrderedPair{3e11, 3e11}
+	b.position = OrderedPair{3e11, 3e11}
+	c.position = OrderedPair{7e11, 7e11}
+	b.velocity.x = 3000
+
+	var u Universe
+	u.width = 1e12
+	u.AddStar(a)
+	u.AddStar(b)
+	u.AddStar(c)
+
+	// bucketing: the tree is built and both coincident stars feel the third one
+	settings := DefaultSettings(1, 0.5)
+	qt, err := BuildQuadTree(&u, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssignClusterPos(qt.root)
+	if qt.root.star.mass != 4e30 {
+		t.Errorf("root mass is %v, want 4e30", qt.root.star.mass)
+	}
+
+	// error policy
+	settings.coincident = ErrorCoincident
+	if _, err := BuildQuadTree(&u, settings); err == nil {
+		t.Errorf("expected an error for coincident stars")
+	}
+
+	// merging conserves mass and momentum
+	settings.coincident = MergeCoincident
+	next, err := UpdateUniverse(&u, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(next.stars) != 2 {
+		t.Fatalf("got %d stars after merging, want 2", len(next.stars))
+	}
+	if math.Abs(next.stars[0].mass-3e30) > 1e16 || math.Abs(next.stars[0].velocity.x-2000) > 1e-9 {
+		t.Errorf("merged star has mass %v and velocity %v", next.stars[0].mass, next.stars[0].velocity.x)
+	}
+
+	// stars a thousand kilometers apart are in leaves of their own, and only merge within the merge radius
+	var near Universe
+	near.width = 1e12
+	near.AddStar(a)
+	b.position = OrderedPair{3e11 + 1e6, 3e11}
+	near.AddStar(b)
+	near.AddStar(c)
+	for _, test := range []struct {
+		softening   Softening
+		mergeRadius float64
+		want        int
+	}{
+		{Softening{}, 0, 3},
+		{Softening{PlummerSoftening, 1e5}, 0, 3},
+		{Softening{PlummerSoftening, 1e7}, 0, 2},
+		{Softening{PlummerSoftening, 1e7}, 1e5, 3},
+		{Softening{}, 2e6, 2},
+	} {
+		settings.softening, settings.mergeRadius = test.softening, test.mergeRadius
+		next, err := UpdateUniverse(&near, settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(next.stars) != test.want {
+			t.Errorf("softening %v and merge radius %v leave %d stars, want %d", test.softening, test.mergeRadius, len(next.stars), test.want)
+		}
+	}
+	if near.stars[0].position.x != 3e11 {
+		t.Errorf("merging moved a star of the previous universe to %v", near.stars[0].position)
+	}
+
+	// coincident stars merge whatever the scale, even where the sectors of the deepest leaves are lost to rounding
+	small := Universe{width: 10}
+	small.AddStar(Star{position: OrderedPair{3, 5}, mass: 1})
+	small.AddStar(Star{position: OrderedPair{3, 5}, mass: 1})
+	small.AddStar(Star{position: OrderedPair{7, 4}, mass: 2})
+	if err := MergeCoincidentStars(&small, DefaultSettings(1, 0.5)); err != nil {
+		t.Fatal(err)
+	}
+	if len(small.stars) != 2 {
+		t.Errorf("got %d stars after merging two coincident stars of three, want 2", len(small.stars))
+	}
+
+	scenario := Scenario{Simulation: SimulationScenario{Generations: 1, TimeStep: 1, MergeRadius: -1}}
+	if _, err := scenario.Settings(); err == nil {
+		t.Errorf("expected an error for a negative merge radius")
+	}
+}
+
+func TestBoundary(t *testing.T) {
+	policies := map[BoundaryPolicy]int{OpenBoundary: 3, DropBoundary: 1, ReflectBoundary: 3, WrapBoundary: 3}
+	for policy, want := range policies {
+		var in, left, far Star
+		in.position = OrderedPair{5, 5}
+		left.position = OrderedPair{-1, 5}
+		left.velocity.x = -2
+		far.position = OrderedPair{5, 23}
+
+		var u Universe
+		u.width = 10
+		u.AddStar(in)
+		u.AddStar(left)
+		u.AddStar(far)
+
+		// the root of the tree covers the stars outside the universe too
+		root := InitRoot(&u)
+		if root.sector.x != -1 || root.sector.y != 5 || root.sector.width != 18 {
+			t.Errorf("root quadrant is %+v", root.sector)
+		}
+
+		if escaped := ApplyBoundary(&u, policy); escaped != 2 {
+			t.Errorf("policy %d: %d stars escaped, want 2", policy, escaped)
+		}
+		if len(u.stars) != want {
+			t.Errorf("policy %d: %d stars left, want %d", policy, len(u.stars), want)
+		}
+		if policy == ReflectBoundary && (u.stars[1].position.x != 1 || u.stars[1].velocity.x != 2) {
+			t.Errorf("reflected star at %v with velocity %v", u.stars[1].position.x, u.stars[1].velocity.x)
+		}
+		if policy == WrapBoundary && (u.stars[1].position.x != 9 || u.stars[2].position.y != 3) {
+			t.Errorf("wrapped stars at %v and %v", u.stars[1].position, u.stars[2].position)
+		}
+	}
+}
+
+func TestParallelMatchesSerial(t *testing.T) {
+	rng := NewRand(1)
+	g0 := InitializeGalaxy(rng, 300, 4e21, 4e22, 3e22)
+	g1 := InitializeGalaxy(rng, 300, 4e21, 3e22, 3e22)
+	push(&g0, OrderedPair{-100, 200})
+	push(&g1, OrderedPair{200, -100})
+	u := InitializeUniverse([]Galaxy{g0, g1}, 1.0e23)
+
+	serial := DefaultSettings(3e15, 0.5)
+	serial.integrator = Leapfrog{}
+	parallel := DefaultSettings(3e15, 0.5)
+	parallel.integrator = Leapfrog{}
+	parallel.workers = 4
+	parallel.parallelTree = true
+
+	expected, err := BarnesHutWithSettings(u, 10, serial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := BarnesHutWithSettings(u, 10, parallel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range expected {
+		for j := range expected[i].stars {
+			if *expected[i].stars[j] != *actual[i].stars[j] {
+				t.Fatalf("generation %d, star %d: serial %+v, parallel %+v", i, j, *expected[i].stars[j], *actual[i].stars[j])
+			}
+		}
+	}
+}
+
+func TestEvolveUniverseStride(t *testing.T) {
+	u := CreateCircularOrbit()
+	settings := DefaultSettings(1e4, 0.5)
+	settings.integrator = Leapfrog{}
+
+	all, err := BarnesHutWithSettings(u, 25, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var generations []int
+	final, err := EvolveUniverse(u, 25, 10, settings, func(generation int, snapshot *Universe) error {
+		generations = append(generations, generation)
+		if *snapshot.stars[1] != *all[generation].stars[1] {
+			t.Errorf("generation %d differs from BarnesHutWithSettings", generation)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(generations) != "[0 10 20]" {
+		t.Errorf("emitted generations %v, want [0 10 20]", generations)
+	}
+	if *final.stars[1] != *all[25].stars[1] {
+		t.Errorf("final universe differs from the last generation")
+	}
+}
+
+func TestCheckpointResume(t *testing.T) {
+	g0 := InitializeGalaxy(NewRand(1), 200, 4e21, 4e22, 3e22)
+	u := InitializeUniverse([]Galaxy{g0}, 1.0e23)
+	path := t.TempDir() + "/checkpoint.bhsn"
+	ignore := func(generation int, u *Universe) error { return nil }
+
+	// the incremental tree is not in the checkpoint: the resumed run, in a new process, starts without one.
+	// Steps are long enough for stars to change leaf, so that an updated tree differs from a new one.
+	for _, rebuildEvery := range []int{0, 6} {
+		newSettings := func() *Settings {
+			settings := DefaultSettings(2e15, 0.5)
+			settings.integrator = Leapfrog{}
+			settings.rebuildEvery = rebuildEvery
+			return settings
+		}
+
+		// checkpoints are written at generations 0, 10 and 20; the last one kept is 20
+		settings := newSettings()
+		expected, err := EvolveUniverse(u, 25, 5, settings, CheckpointEvery(path, 10, settings, ignore))
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := ResumeUniverse(path, 25, 5, newSettings(), ignore)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(actual.stars) != len(expected.stars) {
+			t.Fatalf("rebuildEvery %d: resumed run has %d stars, want %d", rebuildEvery, len(actual.stars), len(expected.stars))
+		}
+		for i := range expected.stars {
+			if *actual.stars[i] != *expected.stars[i] {
+				t.Fatalf("rebuildEvery %d: star %d: resumed %+v, uninterrupted %+v", rebuildEvery, i, *actual.stars[i], *expected.stars[i])
+			}
+		}
+	}
+
+	// a scenario naming a checkpoint without an interval saves the last generation
+	scenario := Scenario{
+		Width:      10,
+		Bodies:     []Body{{Name: "a", Mass: 1, Position: [2]float64{4, 5}}, {Name: "b", Mass: 1, Position: [2]float64{6, 5}}},
+		Simulation: SimulationScenario{Generations: 7, TimeStep: 1},
+		Rendering:  RenderingScenario{CanvasWidth: 10, Frequency: 3},
+		Output:     OutputScenario{Checkpoint: t.TempDir() + "/last.bhsn"},
+	}
+	if err := scenario.Run(); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := ReadCheckpoint(scenario.Output.Checkpoint)
+	if err != nil {
+		t.Fatalf("no checkpoint after a run without checkpointEvery: %v", err)
+	}
+	if snapshot.generation != 7 || len(snapshot.universe.stars) != 2 {
+		t.Errorf("checkpoint of generation %d with %d stars, want the 2 stars of generation 7", snapshot.generation, len(snapshot.universe.stars))
+	}
+}
+
+func TestLoadUniverse(t *testing.T) {
+	u, err := LoadUniverse("systems/jupiter.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jupiter := CreateJupiterSystem()
+	if u.width != jupiter.width || len(u.stars) != len(jupiter.stars) {
+		t.Fatalf("loaded %d stars in width %v", len(u.stars), u.width)
+	}
+	for i := range u.stars {
+		// CreateJupiterSystem computes masses with math.Pow, which is off by an ulp or so
+		if math.Abs(u.stars[i].mass-jupiter.stars[i].mass) < 1e-12*jupiter.stars[i].mass {
+			u.stars[i].mass = jupiter.stars[i].mass
+		}
+		if *u.stars[i] != *jupiter.stars[i] {
+			t.Errorf("body %d: loaded %+v, want %+v", i, *u.stars[i], *jupiter.stars[i])
+		}
+	}
+
+	_, err = ReadUniverseCSV(strings.NewReader("width,10\nmass,radius,x,y,vx,vy\n1,1,1,1,0,0\n-1,1,1,1,0,0\n"), "bad.csv")
+	if err == nil || !strings.Contains(err.Error(), "bad.csv: line 4: mass must be positive") {
+		t.Errorf("unexpected error for a negative mass: %v", err)
+	}
+
+	_, err = ReadUniverseJSON(strings.NewReader(`{"width": 10, "bodies": [{"name": "a", "mass": 1}, {"name": "b", "mass": 1, "color": [0, 300, 0]}]}`), "bad.json")
+	if err == nil || !strings.Contains(err.Error(), "bad.json: bodies[1]: b: color") {
+		t.Errorf("unexpected error for an invalid color: %v", err)
+	}
+}
+
+func TestScenarioFiles(t *testing.T) {
+	for _, name := range []string{"jupiter", "galaxy", "collision"} {
+		scenario, err := LoadScenario("scenarios/" + name + ".json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := scenario.Universe(); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if _, err := scenario.Settings(); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	scenario, _ := LoadScenario("scenarios/collision.json")
+	u, _ := scenario.Universe()
+	settings, _ := scenario.Settings()
+	if len(u.stars) != 1002 || settings.softening.kind != PlummerSoftening || settings.time != 3e15 {
+		t.Errorf("collision scenario has %d stars and settings %+v", len(u.stars), *settings)
+	}
+}
+
+func TestScenarioRunError(t *testing.T) {
+	// two stars at the same point can not be separated under the error policy, so the run fails, and nothing is drawn
+	scenario := Scenario{
+		Width:  10,
+		Bodies: []Body{{Name: "a", Mass: 1, Position: [2]float64{5, 5}}, {Name: "b", Mass: 1, Position: [2]float64{5, 5}}},
+		Simulation: SimulationScenario{
+			Generations: 3,
+			TimeStep:    1,
+			Coincident:  "error",
+		},
+		Rendering: RenderingScenario{CanvasWidth: 10, Frequency: 1},
+		Output:    OutputScenario{PNG: t.TempDir() + "/final.png"},
+	}
+	if err := scenario.Run(); err == nil || !strings.Contains(err.Error(), "cannot be separated") {
+		t.Errorf("the run of coincident stars under the error policy returned %v", err)
+	}
+
+	// checkpoints only see the generations that are drawn
+	scenario.Simulation.Coincident = ""
+	scenario.Bodies[1].Position = [2]float64{6, 5}
+	scenario.Rendering.Frequency = 4
+	scenario.Output.Checkpoint = t.TempDir() + "/run.bhsn"
+	scenario.Output.CheckpointEvery = 6
+	if err := scenario.Run(); err == nil || !strings.Contains(err.Error(), "multiple of the rendering frequency") {
+		t.Errorf("checkpoints every 6 generations with frames every 4 returned %v", err)
+	}
+
+	// diagnostics that can not be written make the run fail
+	if _, err := os.Stat("/dev/full"); err == nil {
+		scenario.Output.Checkpoint = ""
+		scenario.Output.Diagnostics = "/dev/full"
+		if err := scenario.Run(); err == nil {
+			t.Errorf("diagnostics written to a full disk were reported as a success")
+		}
+	}
+
+	// an image that can not be created is an error of the run, not the end of the program
+	scenario.Output.Checkpoint, scenario.Output.Diagnostics = "", ""
+	scenario.Output.PNG = t.TempDir() + "/missing/final.png"
+	if err := scenario.Run(); err == nil || !strings.Contains(err.Error(), "final.png") {
+		t.Errorf("an image in a missing directory returned %v", err)
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	cases := []struct {
+		args []string
+		want int
+	}{
+		{nil, 2},
+		{[]string{"help"}, 0},
+		{[]string{"nonsense"}, 2},
+		{[]string{"simulate", "-help"}, 0},
+		{[]string{"simulate", "-gens", "ten", "systems/jupiter.csv"}, 2},
+		{[]string{"simulate", "-gens", "10", "-dt", "1", "systems/jupiter.csv"}, 2}, // no output
+		{[]string{"inspect", "missing.bhsn"}, 1},
+		{[]string{"inspect", "systems/jupiter.csv"}, 0},
+		{[]string{"bench", "-gens", "3", "-dt", "1", "systems/jupiter.csv"}, 0},
+		{[]string{"bench", "-integrator", "midpoint", "-dt", "1", "systems/jupiter.csv"}, 1},
+	}
+	for _, c := range cases {
+		if got := RunCommand(c.args); got != c.want {
+			t.Errorf("RunCommand(%q) = %d, want %d", c.args, got, c.want)
+		}
+	}
+
+	// an image that can not be written is a failure, reported like the others
+	dir := t.TempDir()
+	if err := WriteCheckpoint(dir+"/orbit.bhsn", CreateCircularOrbit(), 0, DefaultSettings(1, 0.5)); err != nil {
+		t.Fatal(err)
+	}
+	for output, want := range map[string]int{dir + "/orbit.png": 0, dir + "/missing/orbit.png": 1} {
+		if got := RunCommand([]string{"render", "-o", output, dir + "/orbit.bhsn"}); got != want {
+			t.Errorf("render -o %s returned %d, want %d", output, got, want)
+		}
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	u := CreateCircularOrbit()
+	settings := DefaultSettings(1e4, 0.5)
+	settings.integrator = Leapfrog{}
+	var csv strings.Builder
+	settings.diagnostics = &csv
+	settings.diagnosticsEvery = 100
+	settings.exactPotential = true
+
+	if _, err := BarnesHutWithSettings(u, 1000, settings); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(csv.String()), "\n")
+	if len(lines) != 12 || lines[0] != diagnosticsHeader {
+		t.Fatalf("got %d lines of diagnostics starting with %q", len(lines), lines[0])
+	}
+
+	// a circular orbit is in virial equilibrium, and the tree is exact for two stars
+	d, err := ComputeDiagnostics(u, 0, settings, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(d.VirialRatio()-1) > 1e-6 || math.Abs(d.potential-d.potentialTree) > 1e-9*math.Abs(d.potential) {
+		t.Errorf("virial ratio %v, potential %v, tree potential %v", d.VirialRatio(), d.potential, d.potentialTree)
+	}
+}
+
+func TestSeededGalaxies(t *testing.T) {
+	g0 := InitializeGalaxy(NewRand(42), 100, 4e21, 4e22, 3e22)
+	g1 := InitializeGalaxy(NewRand(42), 100, 4e21, 4e22, 3e22)
+	g2 := InitializeGalaxy(NewRand(43), 100, 4e21, 4e22, 3e22)
+	for i := range g0 {
+		if *g0[i] != *g1[i] {
+			t.Fatalf("star %d differs between two galaxies with the same seed", i)
+		}
+	}
+	if *g0[0] == *g2[0] {
+		t.Errorf("galaxies with different seeds start with the same star")
+	}
+
+	// the seed survives a checkpoint
+	seed := int64(42)
+	scenario := Scenario{Seed: &seed, Width: 1e23, Galaxies: []GalaxyScenario{{Stars: 10, Radius: 4e21, Center: [2]float64{5e22, 5e22}}}}
+	u, err := scenario.Universe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := WriteSnapshot(&buf, u, 0, DefaultSettings(1, 0.5)); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := ReadSnapshot(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !snapshot.universe.seeded || snapshot.universe.seed != 42 || *snapshot.universe.stars[3] != *u.stars[3] {
+		t.Errorf("snapshot lost the seed or the stars of the universe")
+	}
+}
+
+func TestModelGalaxy(t *testing.T) {
+	profiles := []Profile{ExponentialDisk{1e41, 3e20}, PlummerSphere{1e41, 3e20}, HernquistSphere{1e41, 3e20}}
+	for _, p := range profiles {
+		// Radius inverts the enclosed mass
+		for _, f := range []float64{0.1, 0.5, 0.9} {
+			if m := p.EnclosedMass(p.Radius(f)); math.Abs(m/p.Mass()-f) > 1e-9 {
+				t.Errorf("%T: radius of mass fraction %v encloses a fraction %v", p, f, m/p.Mass())
+			}
+		}
+	}
+
+	components := DiskBulgeHalo(300, 100, 0, 1e41, 2e40, 0, 3e20, 1e20, 0)
+	g, err := InitializeModelGalaxy(NewRand(1), components, blackHoleMass, 5e21, 5e21)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g) != 401 || g[400].mass != blackHoleMass {
+		t.Fatalf("got %d stars, the last one of mass %v", len(g), g[len(g)-1].mass)
+	}
+
+	// the disk stars all move at the circular velocity of the mass inside their orbit
+	var mass float64
+	for _, s := range g[:400] {
+		mass += s.mass
+	}
+	disk := g[0]
+	r := math.Hypot(disk.position.x-5e21, disk.position.y-5e21)
+	v := math.Hypot(disk.velocity.x, disk.velocity.y)
+	if vmax := math.Sqrt(G * (mass + blackHoleMass) / r); v > vmax || v <= 0 {
+		t.Errorf("disk star at %v m moves at %v m/s, more than %v m/s", r, v, vmax)
+	}
+	if math.Abs(mass-(components[0].enclosedMass(3e21)+components[1].enclosedMass(2e21)))/mass > 1e-9 {
+		t.Errorf("the stars hold %v kg instead of the mass of the components within their cutoff", mass)
+	}
+}
+
+func TestStellarMasses(t *testing.T) {
+	rng := NewRand(1)
+	for _, imf := range []IMF{Salpeter{0.1, 100}, Kroupa{0.01, 100}, Kroupa{1, 10}} {
+		var mean float64
+		for i := 0; i < 10000; i++ {
+			m := imf.Sample(rng)
+			if m < 0.01 || m > 100 {
+				t.Fatalf("%v: drew a mass of %v outside its bounds", imf, m)
+			}
+			mean += m / 10000
+		}
+		// most stars are light, with a long tail of heavy ones
+		if mean > 5 {
+			t.Errorf("%v: mean mass %v", imf, mean)
+		}
+	}
+
+	// heavy stars are hot and blue, light ones cool and red
+	if r, _, b := BlackbodyColor(MainSequenceTemperature(10)); b <= r {
+		t.Errorf("a 10 solar mass star has color red %d, blue %d", r, b)
+	}
+	if r, _, b := BlackbodyColor(MainSequenceTemperature(0.3)); r <= b {
+		t.Errorf("a 0.3 solar mass star has color red %d, blue %d", r, b)
+	}
+	if T := MainSequenceTemperature(1); T != solarTemperature {
+		t.Errorf("the sun has a temperature of %v K", T)
+	}
+
+	// the black hole keeps its mass, the stars keep their total mass when asked to
+	g := InitializeGalaxy(NewRand(2), 200, 4e21, 0, 0)
+	blackHoleMass := g[len(g)-1].mass
+	AssignStellarMasses(NewRand(3), g[:len(g)-1], Salpeter{0.1, 100}, true)
+	var mass float64
+	for _, s := range g[:len(g)-1] {
+		mass += s.mass
+	}
+	if math.Abs(mass-200*solarMass)/mass > 1e-9 || g[len(g)-1].mass != blackHoleMass {
+		t.Errorf("stars hold %v kg and the black hole %v kg", mass, g[len(g)-1].mass)
+	}
+	if g[0].mass == g[1].mass || g[0].radius == g[1].radius {
+		t.Errorf("stars were not given different masses and radii")
+	}
+}
+
+func TestEncounter(t *testing.T) {
+	for _, ecc := range []float64{0.5, 1, 2} {
+		g1 := InitializeGalaxy(NewRand(1), 100, 4e21, 0, 0)
+		g2 := InitializeGalaxy(NewRand(2), 50, 2e21, 0, 0)
+		e := Encounter{
+			mass1:        blackHoleMass + 100*solarMass,
+			mass2:        blackHoleMass + 50*solarMass,
+			pericenter:   4e21,
+			eccentricity: ecc,
+			separation:   1e22,
+			center:       OrderedPair{5e22, 5e22},
+			inclination2: math.Pi / 3,
+			retrograde2:  true,
+		}
+		if err := SetupEncounter(g1, g2, e); err != nil {
+			t.Fatal(err)
+		}
+
+		c1, v1 := g1.CenterOfMass()
+		c2, v2 := g2.CenterOfMass()
+		if d := math.Hypot(c2.x-c1.x, c2.y-c1.y); math.Abs(d-1e22)/1e22 > 1e-9 {
+			t.Errorf("e = %v: galaxies start %v apart", ecc, d)
+		}
+		// the orbit has the energy and angular momentum of the conic
+		rx, ry, vx, vy := c2.x-c1.x, c2.y-c1.y, v2.x-v1.x, v2.y-v1.y
+		m := e.mass1 + e.mass2
+		energy := (vx*vx+vy*vy)/2 - G*m/math.Hypot(rx, ry)
+		if want := G * m * (ecc - 1) / (2 * e.pericenter); math.Abs(energy-want) > 1e-9*G*m/e.pericenter {
+			t.Errorf("e = %v: specific orbital energy %v, expected %v", ecc, energy, want)
+		}
+		if h := rx*vy - ry*vx; math.Abs(h-math.Sqrt(G*m*e.pericenter*(1+ecc)))/h > 1e-9 {
+			t.Errorf("e = %v: specific angular momentum %v", ecc, h)
+		}
+		if rx*vx+ry*vy >= 0 {
+			t.Errorf("e = %v: the galaxies are not approaching", ecc)
+		}
+		// the second galaxy now spins clockwise
+		if s := g2[0]; (s.position.x-c2.x)*(s.velocity.y-v2.y)-(s.position.y-c2.y)*(s.velocity.x-v2.x) >= 0 {
+			t.Errorf("e = %v: retrograde galaxy spins counterclockwise", ecc)
+		}
+	}
+
+	g1 := InitializeGalaxy(NewRand(1), 10, 4e21, 0, 0)
+	g2 := InitializeGalaxy(NewRand(2), 10, 4e21, 0, 0)
+	if err := SetupEncounter(g1, g2, Encounter{mass1: 1e37, mass2: 1e37, pericenter: 4e21, eccentricity: 0.5, separation: 2e22}); err == nil {
+		t.Errorf("separation beyond the apocenter was accepted")
+	}
+}
+
+func TestGalaxyTransforms(t *testing.T) {
+	g := InitializeGalaxy(NewRand(1), 100, 4e21, 1e22, 2e22)
+	push(&g, OrderedPair{10, 20})
+	c, w := g.CenterOfMass()
+	spin := func(g Galaxy) float64 {
+		c, w := g.CenterOfMass()
+		var l float64
+		for _, s := range g {
+			l += s.mass * ((s.position.x-c.x)*(s.velocity.y-w.y) - (s.position.y-c.y)*(s.velocity.x-w.x))
+		}
+		return l
+	}
+	l := spin(g)
+	close := func(a, b, scale float64) bool {
+		return math.Abs(a-b) <= 1e-9*scale
+	}
+
+	// rotations and flips keep the center of mass and the size of the spin
+	g.Rotate(1)
+	if c2, w2 := g.CenterOfMass(); !close(c2.x, c.x, 1e22) || !close(c2.y, c.y, 1e22) || !close(w2.x, w.x, 100) || !close(w2.y, w.y, 100) {
+		t.Errorf("rotation moved the center of mass from %v, %v to %v, %v", c, w, c2, w2)
+	}
+	if !close(spin(g), l, math.Abs(l)) {
+		t.Errorf("rotation changed the angular momentum from %v to %v", l, spin(g))
+	}
+	g.FlipSpin()
+	if !close(spin(g), -l, math.Abs(l)) {
+		t.Errorf("flipped galaxy has angular momentum %v instead of %v", spin(g), -l)
+	}
+
+	g.Translate(OrderedPair{1e21, -1e21})
+	if c2, _ := g.CenterOfMass(); !close(c2.x, c.x+1e21, 1e22) || !close(c2.y, c.y-1e21, 1e22) {
+		t.Errorf("translated center of mass is %v", c2)
+	}
+	g.MoveTo(OrderedPair{0, 0}, OrderedPair{0, 0})
+	if c2, w2 := g.CenterOfMass(); !close(c2.x, 0, 1e22) || !close(c2.y, 0, 1e22) || !close(w2.x, 0, 100) || !close(w2.y, 0, 100) {
+		t.Errorf("galaxy moved to the origin is at %v, moving at %v", c2, w2)
+	}
+
+	// a rescaled galaxy keeps its orbits: its kinetic energy and potential energy keep their ratio
+	u := &Universe{stars: g, width: 1e23}
+	ratio := KineticEnergy(u) / PotentialEnergy(u, Softening{})
+	mass := g.Mass()
+	if err := g.Rescale(4, 2); err != nil {
+		t.Fatal(err)
+	}
+	if !close(g.Mass(), 4*mass, mass) {
+		t.Errorf("rescaled mass is %v instead of %v", g.Mass(), 4*mass)
+	}
+	if r := KineticEnergy(u) / PotentialEnergy(u, Softening{}); !close(r, ratio, math.Abs(ratio)) {
+		t.Errorf("rescaled galaxy has virial ratio %v instead of %v", r, ratio)
+	}
+
+	// factors that would collapse, mirror or blow up the galaxy are refused, and leave it as it was
+	mass = g.Mass()
+	for _, factors := range [][2]float64{{0, 1}, {1, 0}, {-2, 1}, {1, -2}, {math.NaN(), 1}, {1, math.NaN()}, {math.Inf(1), 1}} {
+		if err := g.Rescale(factors[0], factors[1]); err == nil {
+			t.Errorf("rescaling by %v returned no error", factors)
+		}
+	}
+	if g.Mass() != mass {
+		t.Errorf("refused rescalings changed the mass from %v to %v", mass, g.Mass())
+	}
+}
+
+func TestRecenter(t *testing.T) {
+	g := InitializeGalaxy(NewRand(1), 50, 4e21, 2e22, 3e22)
+	push(&g, OrderedPair{300, -200})
+	initial := InitializeUniverse([]Galaxy{g}, 1e23)
+
+	settings := DefaultSettings(1e14, 0.5)
+	settings.integrator = Leapfrog{}
+	settings.frame = Frame{kind: CenterOfMassFrame}
+	ignore := func(int, *Universe) error { return nil }
+	final, err := EvolveUniverse(initial, 20, 20, settings, ignore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, w := Galaxy(final.stars).CenterOfMass()
+	if math.Abs(c.x-5e22) > 1e10 || math.Abs(c.y-5e22) > 1e10 || math.Hypot(w.x, w.y) > 1e-6 {
+		t.Errorf("center of mass at %v moving at %v, expected at rest in the middle of the canvas", c, w)
+	}
+
+	// the black hole is the last star
+	settings.frame = Frame{kind: StarFrame, star: 50}
+	if final, err = EvolveUniverse(initial, 20, 20, settings, ignore); err != nil {
+		t.Fatal(err)
+	}
+	if p := final.stars[50].position; p.x != 5e22 || p.y != 5e22 {
+		t.Errorf("black hole at %v, expected in the middle of the canvas", p)
+	}
+
+	// following a star translates the universe, which leaves the angular momentum of the diagnostics unchanged
+	moved := CopyUniverse(initial)
+	if err := FollowStar(moved, Frame{kind: StarFrame, star: 0}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Recenter(moved, Frame{kind: StarFrame}); err != nil {
+		t.Fatal(err)
+	}
+	if l0, l := AngularMomentum(initial), AngularMomentum(moved); math.Abs(l-l0) > 1e-9*math.Abs(l0) {
+		t.Errorf("angular momentum is %v in the star frame and %v in the fixed frame", l, l0)
+	}
+
+	settings.frame = Frame{kind: StarFrame, star: 51}
+	if _, err = EvolveUniverse(initial, 20, 20, settings, ignore); err == nil {
+		t.Errorf("a frame star out of range was accepted")
+	}
+
+	// the star is followed by identity: a merger in front of it shifts its index, but not the frame
+	var a, b, bh Star
+	a.mass, b.mass, bh.mass = 1, 1, 2
+	a.position, b.position, bh.position = OrderedPair{3, 5}, OrderedPair{3, 5}, OrderedPair{7, 4}
+	pair := &Universe{width: 10}
+	pair.AddStar(a)
+	pair.AddStar(b)
+	pair.AddStar(bh)
+	settings = DefaultSettings(1, 0.5)
+	settings.coincident = MergeCoincident
+	settings.frame = Frame{kind: StarFrame, star: 2}
+	if final, err = EvolveUniverse(pair, 2, 1, settings, ignore); err != nil {
+		t.Fatal(err)
+	}
+	if len(final.stars) != 2 || final.followed != final.stars[1] || final.stars[1].mass != 2 {
+		t.Errorf("after the merger, the frame follows %+v of %d stars", final.followed, len(final.stars))
+	} else if p := final.followed.position; math.Abs(p.x-5) > 1e-9 || math.Abs(p.y-5) > 1e-9 {
+		t.Errorf("followed star at %v, expected in the middle of the canvas", p)
+	}
+
+	// checkpoints remember which star is followed
+	var buf bytes.Buffer
+	if err := WriteSnapshot(&buf, final, 2, settings); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := ReadSnapshot(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.universe.followed != snapshot.universe.stars[1] {
+		t.Errorf("the snapshot follows %+v instead of the second star", snapshot.universe.followed)
+	}
+
+	// a dropped star is no longer followed, and the center of mass takes its place
+	final.followed.position.x = 20
+	ApplyBoundary(final, DropBoundary)
+	if final.followed != nil {
+		t.Errorf("the frame follows a dropped star")
+	}
+	if err := Recenter(final, settings.frame); err != nil {
+		t.Fatal(err)
+	}
+	if p := final.stars[0].position; math.Abs(p.x-5) > 1e-9 || math.Abs(p.y-5) > 1e-9 {
+		t.Errorf("last star at %v, expected in the middle of the canvas once the followed star is gone", p)
+	}
+}
+
+func TestBlockLeapfrog(t *testing.T) {
+	// inner moons get finer steps than outer ones, and Jupiter, at rest, the whole step
+	jupiter := CreateJupiterSystem()
+	if err := SetAccelerations(jupiter, DefaultSettings(1, 0.5)); err != nil {
+		t.Fatal(err)
+	}
+	block := BlockLeapfrog{eta: 0.01, maxLevel: 10}
+	levels := block.Levels(jupiter, 1e4, Softening{})
+	if levels[0] != 0 || !(levels[1] > levels[4]) {
+		t.Errorf("levels of Jupiter, Io, Europa, Ganymede and Callisto for a step of 1e4 s: %v", levels)
+	}
+
+	// a circular orbit stays circular with steps of a tenth of a period, where the plain leapfrog drifts away
+	u := CreateCircularOrbit()
+	r0 := Dist(u.stars[0], u.stars[1])
+	period := 2 * math.Pi * r0 / u.stars[1].velocity.y
+	drift := make(map[string]float64)
+	for name, integrator := range map[string]Integrator{"leapfrog": Leapfrog{}, "block": block} {
+		settings := DefaultSettings(period/10, 0.5)
+		settings.integrator = integrator
+		timePoints, err := BarnesHutWithSettings(u, 10, settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		last := timePoints[len(timePoints)-1]
+		drift[name] = math.Abs(Dist(last.stars[0], last.stars[1])-r0) / r0
+	}
+	if drift["block"] > 1e-3 || drift["block"] > drift["leapfrog"] {
+		t.Errorf("relative drift of the orbital radius after one period: %v", drift)
+	}
+
+	// when every star is at level 0, the step is a single tick: the plain leapfrog, down to the last bit
+	settings := DefaultSettings(1, 0.5)
+	coarse := BlockLeapfrog{eta: 1e6, maxLevel: 10}
+	if levels := coarse.Levels(u, 1, Softening{}); levels[0] != 0 || levels[1] != 0 {
+		t.Fatalf("levels for a step of 1 s: %v", levels)
+	}
+	settings.integrator = Leapfrog{}
+	want, err := BarnesHutWithSettings(u, 3, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings.integrator = coarse
+	got, err := BarnesHutWithSettings(u, 3, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range want[3].stars {
+		if *got[3].stars[i] != *want[3].stars[i] {
+			t.Errorf("star %d: %+v with the block leapfrog at level 0, %+v with the leapfrog", i, *got[3].stars[i], *want[3].stars[i])
+		}
+	}
+
+	// a time scale too short for dt over the step to be finite gets the finest level, not an undefined one
+	var crawling Star
+	crawling.mass = 1
+	crawling.velocity.x = 5e-324
+	crawling.acceleration.x = 1
+	tiny := &Universe{width: 10}
+	tiny.AddStar(crawling)
+	block = BlockLeapfrog{eta: 0.01, maxLevel: 10}
+	if levels := block.Levels(tiny, 1, Softening{}); levels[0] != 10 {
+		t.Fatalf("level %d for a time scale of 5e-324 s, want the finest level 10", levels[0])
+	}
+	if err := block.Step(tiny, 1, DefaultSettings(1, 0.5)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdaptiveTimeStep(t *testing.T) {
+	// an eccentric orbit: the step shrinks near the sun, where the planet is fast
+	u := CreateCircularOrbit()
+	u.stars[1].velocity.y *= 1.3
+	settings := DefaultSettings(1e5, 0.5)
+	settings.integrator = Leapfrog{}
+	settings.tolerance = 0.01
+
+	var steps []float64
+	var times []float64
+	_, err := EvolveUniverse(u, 2000, 1, settings, func(generation int, u *Universe) error {
+		if n := len(times); n > 0 {
+			steps = append(steps, u.time-times[n-1])
+		}
+		times = append(times, u.time)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	min, max := math.Inf(1), 0.0
+	for _, dt := range steps {
+		min, max = math.Min(min, dt), math.Max(max, dt)
+	}
+	if !(min > 0) || max > 1e5 || max < 2*min {
+		t.Errorf("steps ranged from %v to %v s", min, max)
+	}
+
+	// a checkpoint keeps the simulated time
+	var buf bytes.Buffer
+	last := &Universe{width: 1, time: times[len(times)-1]}
+	if err := WriteSnapshot(&buf, last, 2000, settings); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := ReadSnapshot(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.universe.time != last.time {
+		t.Errorf("snapshot read back with time %v, expected %v", snapshot.universe.time, last.time)
+	}
+
+	// frames are drawn at the first universe past every second, once for several seconds crossed at once
+	var timePoints []*Universe
+	for _, time := range []float64{0, 1, 1.5, 2.5, 2.6, 5, 5.5} {
+		timePoints = append(timePoints, &Universe{width: 1, time: time})
+	}
+	if frames := AnimateSystemByTime(timePoints, 10, 1, 1); len(frames) != 4 {
+		t.Errorf("drew %d frames, expected 4", len(frames))
+	}
+}
+
+// accelerationError returns the rms error of the accelerations of u computed with settings, against direct summation,
+// relative to the rms acceleration. Single relative errors would blow up for stars such as the central black hole, whose
+// acceleration nearly cancels out.
+func accelerationError(u *Universe, settings *Settings) (float64, error) {
+	exact, err := ComputeAccelerations(u, DefaultSettings(settings.time, 0))
+	if err != nil {
+		return 0, err
+	}
+	acc, err := ComputeAccelerations(u, settings)
+	if err != nil {
+		return 0, err
+	}
+	var errors, norms float64
+	for i := range acc {
+		dx, dy := acc[i].x-exact[i].x, acc[i].y-exact[i].y
+		errors += dx*dx + dy*dy
+		norms += exact[i].x*exact[i].x + exact[i].y*exact[i].y
+	}
+	return math.Sqrt(errors / norms), nil
+}
+
+// twoGalaxies returns two overlapping galaxies of n stars each, drawn from NewRand(1), with two copies of their
+// first star that only a bucket can hold, and the generator for whatever else the test draws.
+func twoGalaxies(n int) (*Universe, *rand.Rand) {
+	rng := NewRand(1)
+	g0 := InitializeGalaxy(rng, n, 4e21, 4e22, 3e22)
+	g1 := InitializeGalaxy(rng, n, 4e21, 3e22, 3e22)
+	u := InitializeUniverse([]Galaxy{g0, g1}, 1e23)
+	u.AddStar(*u.stars[0])
+	u.AddStar(*u.stars[0])
+	return u, rng
+}
+
+// differentNode returns the path below a, named where, to the first node where the trees of a and b differ in
+// their sectors, children, stars or buckets, and "" when they are the same
+func differentNode(a, b *Node, where string) string {
+	if a.sector != b.sector || (a.children == nil) != (b.children == nil) || len(a.bucket) != len(b.bucket) {
+		return where
+	}
+	if a.children == nil {
+		if a.bucket == nil && a.star != b.star {
+			return where
+		}
+		for i := range a.bucket {
+			if a.bucket[i] != b.bucket[i] {
+				return where
+			}
+		}
+		return ""
+	}
+	if a.star.position != b.star.position {
+		return where
+	}
+	for q := range a.children {
+		if (a.children[q] == nil) != (b.children[q] == nil) {
+			return fmt.Sprintf("%s/%d", where, q)
+		}
+		if a.children[q] == nil {
+			continue
+		}
+		if a.children[q].parent != a || b.children[q].parent != b {
+			return fmt.Sprintf("%s/%d", where, q)
+		}
+		if d := differentNode(a.children[q], b.children[q], fmt.Sprintf("%s/%d", where, q)); d != "" {
+			return d
+		}
+	}
+	return ""
+}
+
+// assertSameAccelerations fails the test unless every acceleration of got is within 1e-9 of the one of want, relatively:
+// the two were computed with trees that differ only in the order of their sums.
+func assertSameAccelerations(t *testing.T, got, want []OrderedPair, what string) {
+	t.Helper()
+	for i := range want {
+		if d := math.Hypot(got[i].x-want[i].x, got[i].y-want[i].y); d > 1e-9*math.Hypot(want[i].x, want[i].y) {
+			t.Fatalf("%s: star %d accelerates by %v, want %v", what, i, got[i], want[i])
+		}
+	}
+}
+
+func TestQuadrupole(t *testing.T) {
+	// the moment of two equal masses on the x axis, about their center
+	var q Quadrupole
+	q.AddMass(1, OrderedPair{1, 0})
+	q.AddMass(1, OrderedPair{-1, 0})
+	if q != (Quadrupole{xx: 4, xy: 0, yy: -2}) {
+		t.Errorf("quadrupole of a pair is %+v", q)
+	}
+	// far along the axis, the pair pulls harder than a single star of the same mass: G 2m/r^2 (1 + 3/r^2)
+	a := q.Acceleration(OrderedPair{100, 0})
+	if want := -G * 2 * 3 / math.Pow(100, 4); math.Abs(a.x-want) > 1e-9*math.Abs(want) || a.y != 0 {
+		t.Errorf("quadrupole acceleration %v, expected %v", a, want)
+	}
+
+	u := InitializeUniverse([]Galaxy{InitializeGalaxy(NewRand(1), 500, 4e21, 5e22, 5e22)}, 1e23)
+	for _, theta := range []float64{0.5, 1} {
+		settings := DefaultSettings(1, theta)
+		monopole, err := accelerationError(u, settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		settings.multipole = QuadrupoleOrder
+		quadrupole, err := accelerationError(u, settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if quadrupole > monopole/2 {
+			t.Errorf("theta %v: rms acceleration error %v with quadrupoles, %v without", theta, quadrupole, monopole)
+		}
+	}
+}
+
+func BenchmarkMultipole(b *testing.B) {
+	u := InitializeUniverse([]Galaxy{InitializeGalaxy(NewRand(1), 5000, 4e21, 5e22, 5e22)}, 1e23)
+	orders := map[string]MultipoleOrder{"monopole": MonopoleOrder, "quadrupole": QuadrupoleOrder}
+	for orderName, order := range orders {
+		for _, theta := range []float64{0.3, 0.5, 0.8} {
+			settings := DefaultSettings(1, theta)
+			settings.multipole = order
+			name := fmt.Sprintf("%s/theta=%v", orderName, theta)
+			b.Run(name, func(b *testing.B) {
+				rms, err := accelerationError(u, settings)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := ComputeAccelerations(u, settings); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(rms, "rms-error")
+			})
+		}
+	}
+}
+
+func TestFlatTree(t *testing.T) {
+	u, _ := twoGalaxies(300)
+
+	for _, multipole := range []MultipoleOrder{MonopoleOrder, QuadrupoleOrder} {
+		settings := DefaultSettings(1, 0.5)
+		settings.multipole = multipole
+		settings.maxDepth = 20
+		want, err := ComputeAccelerations(u, settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		settings.flatTree = true
+		settings.workers = 4
+		got, err := ComputeAccelerations(u, settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertSameAccelerations(t, got, want, fmt.Sprintf("multipole %d, flat tree against pointer tree", multipole))
+	}
+
+	// the memory of the tree comes with the settings, so computing forces leaves them untouched
+	settings := DefaultSettings(1, 0.5)
+	for _, flat := range []bool{true, false} {
+		settings.flatTree = flat
+		settings.rebuildEvery = 0
+		if !flat {
+			settings.rebuildEvery = 4
+		}
+		before := *settings
+		if _, err := ComputeAccelerations(u, settings); err != nil {
+			t.Fatal(err)
+		}
+		if *settings != before || settings.arena == nil || settings.incremental == nil {
+			t.Errorf("flat tree %v: computing forces changed the settings", flat)
+		}
+	}
+
+	// once grown, the tree is rebuilt and walked without allocating
+	settings = DefaultSettings(1, 0.5)
+	var tree FlatTree
+	if err := tree.Build(u, settings); err != nil {
+		t.Fatal(err)
+	}
+	allocs := testing.AllocsPerRun(10, func() {
+		tree.Build(u, settings)
+		for _, s := range u.stars {
+			tree.Acceleration(s, settings)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("a step allocates %v times", allocs)
+	}
+
+	settings.coincident = ErrorCoincident
+	settings.maxDepth = 20
+	if err := tree.Build(u, settings); err == nil {
+		t.Errorf("coincident stars were accepted under the error policy")
+	}
+}
+
+func BenchmarkTree(b *testing.B) {
+	u := InitializeUniverse([]Galaxy{InitializeGalaxy(NewRand(1), 5000, 4e21, 5e22, 5e22)}, 1e23)
+	SortStarsByMorton(u)
+	modes := map[string]func(*Settings){
+		"pointer": func(*Settings) {},
+		"flat":    func(s *Settings) { s.flatTree = true },
+		"morton":  func(s *Settings) { s.mortonOrder = true },
+		// the stars do not move, so this is the cost of refitting the tree rather than building it
+		"incremental": func(s *Settings) { s.rebuildEvery = 1 << 30 },
+		"group":       func(s *Settings) { s.groupSize = 16 },
+		"fmm":         func(s *Settings) { s.solver = FMMSolver },
+	}
+	for name, mode := range modes {
+		settings := DefaultSettings(1, 0.5)
+		mode(settings)
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := ComputeAccelerations(u, settings); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestMortonTree(t *testing.T) {
+	if k := MortonKey(OrderedPair{0.75, 0.25}, Quadrant{0, 0, 1}); k>>62 != 1 {
+		t.Errorf("a point in the SE quadrant has key %x", k)
+	}
+
+	u, _ := twoGalaxies(300)
+
+	// the Morton tree is the tree built by insertion, so both give the same forces, down to the last bit
+	for _, maxDepth := range []int{20, DefaultMaxDepth} {
+		settings := DefaultSettings(1, 0.5)
+		settings.maxDepth = maxDepth
+		want, err := ComputeAccelerations(u, settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		settings.mortonOrder = true
+		got, err := ComputeAccelerations(u, settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("max depth %d: star %d accelerates by %v in the Morton tree and %v in the inserted tree", maxDepth, i, got[i], want[i])
+			}
+		}
+	}
+
+	// and node for node, whether the keys run out before maxDepth or not
+	for _, maxDepth := range []int{1, 20, mortonBits, 40, DefaultMaxDepth} {
+		settings := DefaultSettings(1, 0.5)
+		settings.maxDepth = maxDepth
+		inserted, err := BuildQuadTree(u, settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		morton, err := BuildQuadTreeMorton(u, settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if where := differentNode(inserted.root, morton.root, "root"); where != "" {
+			t.Errorf("max depth %d: the Morton tree differs from the inserted tree at %s", maxDepth, where)
+		}
+	}
+
+	// stars on the dividing lines of the root go to the same quadrants as with whichSubQuad
+	ties := &Universe{width: 4}
+	for _, p := range []OrderedPair{{0, 0}, {0, 1}, {0, 2}, {2, 0}} {
+		ties.AddStar(Star{position: p, mass: 1})
+	}
+	settings := DefaultSettings(1, 0.9)
+	want, err := ComputeAccelerations(ties, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings.mortonOrder = true
+	got, err := ComputeAccelerations(ties, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("star %d on a dividing line accelerates by %v in the Morton tree and %v in the inserted tree", i, got[i], want[i])
+		}
+	}
+
+	// deep in this tree, the halved sectors and the quantized keys round a star on a dividing line differently
+	rounded := &Universe{width: 1}
+	for _, p := range []OrderedPair{{0.08739353609409908, 0.2621806082822973}, {0, 0.2184838402352477}, {0.6991482887527927, 0.6991482887527927}, {0, 0}} {
+		rounded.AddStar(Star{position: p, mass: 1})
+	}
+	settings = DefaultSettings(1, 0.5)
+	inserted, err := BuildQuadTree(rounded, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	morton, err := BuildQuadTreeMorton(rounded, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if where := differentNode(inserted.root, morton.root, "root"); where != "" {
+		t.Errorf("with rounding on a dividing line, the Morton tree differs from the inserted tree at %s", where)
+	}
+
+	// sorting permutes the stars along the curve
+	sorted := CopyUniverse(u)
+	SortStarsByMorton(sorted)
+	q := BoundingQuadrant(u)
+	seen := make(map[*Star]bool)
+	for i, s := range sorted.stars {
+		seen[s] = true
+		if i > 0 && MortonKey(sorted.stars[i-1].position, q) > MortonKey(s.position, q) {
+			t.Fatalf("stars %d and %d are out of order", i-1, i)
+		}
+	}
+	if len(seen) != len(u.stars) {
+		t.Errorf("sorting lost stars: %d of %d left", len(seen), len(u.stars))
+	}
+
+	settings = DefaultSettings(1, 0.5)
+	settings.mortonOrder = true
+	settings.coincident = ErrorCoincident
+	if _, err := BuildQuadTree(u, settings); err == nil {
+		t.Errorf("coincident stars were accepted under the error policy")
+	}
+
+	// sorting moves the stars around u.stars, and a star frame follows its star wherever it goes
+	settings.coincident = BucketCoincident
+	settings.frame = Frame{kind: StarFrame, star: 7}
+	if err := FollowStar(u, settings.frame); err != nil {
+		t.Fatal(err)
+	}
+	next, err := UpdateUniverse(u, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, s := range next.stars {
+		found = found || s == next.followed
+	}
+	if p := next.followed.position; !found || math.Abs(p.x-u.width/2) > 1e-9*u.width || math.Abs(p.y-u.width/2) > 1e-9*u.width {
+		t.Errorf("the star frame lost its star in the Morton order: followed star at %v", p)
+	}
+}
+
+func TestIncrementalTree(t *testing.T) {
+	u, rng := twoGalaxies(300)
+
+	// with theta = 0 every tree gives the exact forces, so the updated tree must hold every star once
+	settings := DefaultSettings(1, 0)
+	settings.maxDepth = 20
+	settings.rebuildEvery = 100
+	for step := 0; step < 10; step++ {
+		want, err := ComputeAccelerations(u, DefaultSettings(1, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ComputeAccelerations(u, settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertSameAccelerations(t, got, want, fmt.Sprintf("step %d, updated tree against a new one", step))
+		for i, leaf := range settings.incremental.leaves {
+			if !leaf.sector.contains(u.stars[i].position) {
+				t.Fatalf("step %d: star %d is not in the sector of its leaf", step, i)
+			}
+		}
+
+		// move the stars by a fraction of the size of the galaxies, keeping the first two inside the root
+		u = CopyUniverse(u)
+		for _, s := range u.stars[2:] {
+			s.position.x += 2e20 * rng.NormFloat64()
+			s.position.y += 2e20 * rng.NormFloat64()
+		}
+	}
+	if tree := settings.incremental; tree.rebuilds != 1 || tree.moved == 0 {
+		t.Errorf("%d stars moved over %d builds, want some over 1", tree.moved, tree.rebuilds)
+	}
+
+	// the tree is built from scratch every rebuildEvery updates, or as soon as too many stars moved
+	settings.incremental = &IncrementalTree{}
+	settings.rebuildEvery = 3
+	for i := 0; i < 7; i++ {
+		if _, err := ComputeAccelerations(u, settings); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := settings.incremental.rebuilds; n != 3 {
+		t.Errorf("7 updates rebuilt the tree %d times, want 3", n)
+	}
+	settings.rebuildFraction = 1e-6
+	for i := 0; i < 3; i++ {
+		u = CopyUniverse(u)
+		for _, s := range u.stars[2:] {
+			s.position.x += 2e20 * rng.NormFloat64()
+		}
+		if _, err := ComputeAccelerations(u, settings); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := settings.incremental.rebuilds; n != 4 {
+		t.Errorf("after stars changed leaf, the tree was rebuilt %d times, want 4", n)
+	}
+
+	u.AddStar(*u.stars[0])
+	settings.coincident = ErrorCoincident
+	if _, err := ComputeAccelerations(u, settings); err == nil {
+		t.Errorf("coincident stars were accepted under the error policy")
+	}
+}
+
+func TestGroupWalk(t *testing.T) {
+	u, _ := twoGalaxies(300)
+
+	for _, multipole := range []MultipoleOrder{MonopoleOrder, QuadrupoleOrder} {
+		settings := DefaultSettings(1, 0.5)
+		settings.multipole = multipole
+		settings.maxDepth = 20
+		want, err := ComputeAccelerations(u, settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		perStar, err := accelerationError(u, settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// groups of one star, or of coincident stars, see the clusters the stars see on their own
+		settings.groupSize = 1
+		got, err := ComputeAccelerations(u, settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertSameAccelerations(t, got, want, fmt.Sprintf("multipole %d, groups of one against the walk star by star", multipole))
+
+		// larger groups open at least the clusters their stars would open
+		for _, size := range []int{8, 32} {
+			settings.groupSize = size
+			grouped, err := accelerationError(u, settings)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if grouped > perStar {
+				t.Errorf("multipole %d: groups of %d have an error of %g, more than the %g of the walk star by star", multipole, size, grouped, perStar)
+			}
+		}
+	}
+
+	// with theta = 0 the groups sum every star directly, and the block time step only walks the groups it needs
+	settings := DefaultSettings(1, 0)
+	settings.maxDepth = 20
+	want, err := ComputeAccelerations(u, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings.groupSize = 16
+	settings.workers = 4
+	some := []*Star{u.stars[5], u.stars[400], u.stars[len(u.stars)-1]}
+	got, err := ComputeAccelerationsOf(u, some, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameAccelerations(t, got, []OrderedPair{want[5], want[400], want[len(u.stars)-1]}, "some stars in their groups against the exact sum")
+
+	// every star is in exactly one group
+	qt, err := BuildQuadTree(u, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssignClusterPos(qt.root)
+	seen := make(map[*Star]bool)
+	for _, g := range FindGroups(qt.root, 16) {
+		if len(g.stars) > 16 {
+			t.Errorf("a group holds %d stars", len(g.stars))
+		}
+		for _, s := range g.stars {
+			if seen[s] {
+				t.Fatalf("star at %v is in two groups", s.position)
+			}
+			seen[s] = true
+		}
+	}
+	if len(seen) != len(u.stars) {
+		t.Errorf("the groups hold %d of the %d stars", len(seen), len(u.stars))
+	}
+}
+
+func TestFMM(t *testing.T) {
+	u, _ := twoGalaxies(1000)
+
+	// with theta = 0 no clusters are well separated, and every star is summed directly
+	settings := DefaultSettings(1, 0)
+	settings.maxDepth = 20
+	want, err := ComputeAccelerations(u, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings.solver = FMMSolver
+	got, err := ComputeAccelerations(u, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameAccelerations(t, got, want, "FMM with theta = 0 against the exact sum")
+
+	// the error of the expansions shrinks with theta
+	for _, multipole := range []MultipoleOrder{MonopoleOrder, QuadrupoleOrder} {
+		previous := math.Inf(1)
+		for _, theta := range []float64{0.8, 0.5, 0.3} {
+			settings := DefaultSettings(1, theta)
+			settings.multipole = multipole
+			settings.solver = FMMSolver
+			fmm, err := accelerationError(u, settings)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmm >= previous || fmm > 0.01 {
+				t.Errorf("multipole %d, theta %g: the FMM error is %g, after %g", multipole, theta, fmm, previous)
+			}
+			previous = fmm
+		}
+	}
+
+	// the gradient of the quadrupole term, against finite differences
+	q := Quadrupole{xx: 3, xy: -1.5, yy: 2}
+	r := OrderedPair{1.3, -0.7}
+	h := 1e-6
+	xx, xy, yy := q.Gradient(r)
+	px, mx := q.Acceleration(OrderedPair{r.x + h, r.y}), q.Acceleration(OrderedPair{r.x - h, r.y})
+	py, my := q.Acceleration(OrderedPair{r.x, r.y + h}), q.Acceleration(OrderedPair{r.x, r.y - h})
+	for _, c := range [][2]float64{{xx, (px.x - mx.x) / (2 * h)}, {xy, (px.y - mx.y) / (2 * h)}, {xy, (py.x - my.x) / (2 * h)}, {yy, (py.y - my.y) / (2 * h)}} {
+		if math.Abs(c[0]-c[1]) > 1e-6*math.Abs(c[1]) {
+			t.Errorf("the gradient of the quadrupole term is %g, finite differences give %g", c[0], c[1])
+		}
+	}
+
+	// the quadrants of the root are independent, so the workers find the same forces, down to the last bit
+	settings = DefaultSettings(1, 0.5)
+	settings.solver = FMMSolver
+	want, err = ComputeAccelerations(u, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings.workers = 4
+	some := []*Star{u.stars[5], u.stars[1500]}
+	got, err = ComputeAccelerationsOf(u, some, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[0] != want[5] || got[1] != want[1500] {
+		t.Errorf("the workers find %v, the serial solver %v", got, []OrderedPair{want[5], want[1500]})
+	}
+
+	// options that can not work together are refused rather than ignored
+	for name, combine := range map[string]func(*Settings){
+		"FMM and flat tree":         func(s *Settings) { s.solver, s.flatTree = FMMSolver, true },
+		"FMM and group walk":        func(s *Settings) { s.solver, s.groupSize = FMMSolver, 16 },
+		"flat tree and group walk":  func(s *Settings) { s.flatTree, s.groupSize = true, 16 },
+		"flat tree and incremental": func(s *Settings) { s.flatTree, s.rebuildEvery = true, 10 },
+	} {
+		settings := DefaultSettings(1, 0.5)
+		combine(settings)
+		if _, err := ComputeAccelerations(u, settings); err == nil {
+			t.Errorf("%s were combined", name)
+		}
+	}
+	scenario := Scenario{Simulation: SimulationScenario{Generations: 1, TimeStep: 1, Solver: "fmm", FlatTree: true}}
+	if _, err := scenario.Settings(); err == nil {
+		t.Errorf("a scenario combined the FMM solver with a flat tree")
+	}
+	if _, err := ParseForceSolver("direct"); err == nil {
+		t.Errorf("an unknown solver was accepted")
+	}
+}
@@ -0,0 +1,102 @@
+/*
+	stores the block time step integrator: every star advances with its own time step, a power-of-two
+	fraction of the time step of the simulation, so that fast inner orbits no longer set the pace for all
+*/
+
+package main
+
+import "math"
+
+// BlockLeapfrog is a kick-drift-kick leapfrog in which every star has its own time step.
+// At the start of every step of length dt, each star gets a level l between 0 and maxLevel, and then advances
+// with steps of dt / 2^l: the largest such step no longer than eta times its time scale (see Star.TimeScale).
+// The step of length dt is cut into 2^l ticks, l being the deepest level of any star; at the end of a tick only
+// the stars whose own step ends there have their forces computed, and the quad tree is only built when at least
+// one star does.
+// All stars are synchronized again at the end of the step, so snapshots and diagnostics see consistent states.
+type BlockLeapfrog struct {
+	eta      float64
+	maxLevel int
+}
+
+// DefaultBlockLeapfrog has an accuracy parameter of 0.02 and up to 2^10 ticks per step.
+var DefaultBlockLeapfrog = BlockLeapfrog{eta: 0.02, maxLevel: 10}
+
+func (BlockLeapfrog) Start(u *Universe, settings *Settings) error {
+	return SetAccelerations(u, settings)
+}
+
+func (b BlockLeapfrog) Step(u *Universe, dt float64, settings *Settings) error {
+	levels := b.Levels(u, dt, settings.softening)
+	// the ticks are as short as the shortest step of a star, not as short as the deepest level allowed
+	top := 0
+	for _, l := range levels {
+		if l > top {
+			top = l
+		}
+	}
+	ticks := 1 << uint(top)
+	h := dt / float64(ticks)
+
+	// the number of ticks in the own step of every star
+	strides := make([]int, len(u.stars))
+	for i, l := range levels {
+		strides[i] = 1 << uint(top-l)
+	}
+
+	active := make([]*Star, 0, len(u.stars))
+	for t := 0; t < ticks; t++ {
+		for i, s := range u.stars {
+			if t%strides[i] == 0 {
+				s.Kick(float64(strides[i]) * h / 2)
+			}
+		}
+		for _, s := range u.stars {
+			s.Drift(h)
+		}
+
+		active = active[:0]
+		var steps []float64
+		for i, s := range u.stars {
+			if (t+1)%strides[i] == 0 {
+				active = append(active, s)
+				steps = append(steps, float64(strides[i])*h)
+			}
+		}
+		if len(active) == 0 {
+			continue
+		}
+		acc, err := ComputeAccelerationsOf(u, active, settings)
+		if err != nil {
+			return err
+		}
+		for i, s := range active {
+			s.acceleration = acc[i]
+			s.Kick(steps[i] / 2)
+		}
+	}
+	return nil
+}
+
+// Levels returns the level of every star of u for a step of length dt, indexed like u.stars: star i advances with steps of dt / 2^levels[i].
+func (b BlockLeapfrog) Levels(u *Universe, dt float64, softening Softening) []int {
+	levels := make([]int, len(u.stars))
+	for i, s := range u.stars {
+		step := b.eta * s.TimeScale(softening)
+		l := 0
+		if step < dt {
+			// a time scale of 0, or too small for dt/step to be finite, gets the finest level; the conversion of
+			// an infinite float to int is not defined
+			if r := math.Ceil(math.Log2(dt / step)); math.IsInf(r, 1) || r > float64(b.maxLevel) {
+				l = b.maxLevel
+			} else {
+				l = int(r)
+			}
+		}
+		if l < 0 {
+			l = 0
+		}
+		levels[i] = l
+	}
+	return levels
+}
@@ -0,0 +1,60 @@
+/*
+	stores what happens to stars that cross the edge of the universe
+*/
+
+package main
+
+import (
+	"math"
+)
+
+// ApplyBoundary counts the stars of u found outside [0, width] and handles them according to policy.
+// It returns the number of stars that were outside.
+func ApplyBoundary(u *Universe, policy BoundaryPolicy) int {
+	escaped := 0
+	kept := u.stars[:0]
+	for _, s := range u.stars {
+		if s.isInUniverse(u) {
+			kept = append(kept, s)
+			continue
+		}
+		escaped++
+
+		switch policy {
+		case DropBoundary:
+			if s == u.followed {
+				u.followed = nil
+			}
+			continue
+		case ReflectBoundary:
+			s.position.x, s.velocity.x = reflect(s.position.x, s.velocity.x, u.width)
+			s.position.y, s.velocity.y = reflect(s.position.y, s.velocity.y, u.width)
+		case WrapBoundary:
+			s.position.x = wrap(s.position.x, u.width)
+			s.position.y = wrap(s.position.y, u.width)
+		}
+		kept = append(kept, s)
+	}
+	u.stars = kept
+	return escaped
+}
+
+// reflect mirrors a coordinate x that went past 0 or w back inside, reversing its velocity v
+func reflect(x, v, w float64) (float64, float64) {
+	if x < 0 {
+		x, v = -x, -v
+	} else if x > w {
+		x, v = 2*w-x, -v
+	}
+	// a star fast enough to cross the whole universe in one step is just put on the edge
+	return math.Min(math.Max(x, 0), w), v
+}
+
+// wrap moves a coordinate x back into [0, w) as if the universe were a torus
+func wrap(x, w float64) float64 {
+	x = math.Mod(x, w)
+	if x < 0 {
+		x += w
+	}
+	return x
+}
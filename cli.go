@@ -0,0 +1,446 @@
+/*
+	stores the command-line interface: subcommands, their flags and help text
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// command is one subcommand of the program
+type command struct {
+	name    string
+	args    string // positional arguments, for the usage line
+	summary string
+	run     func(args []string) error
+}
+
+// usageError is returned for malformed command lines; it makes the program exit with status 2 instead of 1
+type usageError struct {
+	msg string
+}
+
+func (e usageError) Error() string {
+	return e.msg
+}
+
+func commands() []command {
+	return []command{
+		{"simulate", "<scenario.json | bodies.csv | bodies.json>", "run a simulation and write its animation", simulateCommand},
+		{"render", "<checkpoint>", "draw a checkpoint to a PNG image", renderCommand},
+		{"inspect", "<checkpoint | scenario.json | bodies.csv | bodies.json>", "print a summary of a universe", inspectCommand},
+		{"bench", "<scenario.json | bodies.csv | bodies.json>", "time a few generations without drawing anything", benchCommand},
+		{"run", "<scenario.json>", "run a scenario file as it is (same as simulate without flags)", func(args []string) error {
+			if len(args) != 1 {
+				return usageError{"run takes exactly one scenario file"}
+			}
+			return RunScenario(args[0])
+		}},
+		{"jupiter", "", "the original Jupiter moons example", noArgs(JupiterSimulation)},
+		{"galaxy", "", "the original single galaxy example", noArgs(GalaxySimulation)},
+		{"collision", "", "the original galaxy collision example", noArgs(CollisionSimulation)},
+	}
+}
+
+// RunCommand runs the subcommand named by args[0] and returns the exit status of the program:
+// 0 on success, 1 when the command failed and 2 when the command line is wrong.
+func RunCommand(args []string) int {
+	if len(args) == 0 {
+		printUsage()
+		return 2
+	}
+	if args[0] == "help" || args[0] == "-h" || args[0] == "-help" || args[0] == "--help" {
+		printUsage()
+		return 0
+	}
+
+	for _, c := range commands() {
+		if c.name != args[0] {
+			continue
+		}
+		err := c.run(args[1:])
+		var usage usageError
+		switch {
+		case err == nil:
+			return 0
+		case errors.Is(err, flag.ErrHelp):
+			// the flag package has already printed the help text
+			return 0
+		case errors.As(err, &usage):
+			fmt.Fprintf(os.Stderr, "barnes-hut %s: %v\n", c.name, err)
+			fmt.Fprintf(os.Stderr, "run 'barnes-hut %s -help' for usage\n", c.name)
+			return 2
+		default:
+			fmt.Fprintf(os.Stderr, "barnes-hut %s: %v\n", c.name, err)
+			return 1
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "barnes-hut: unknown command %q\n", args[0])
+	printUsage()
+	return 2
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "usage: barnes-hut <command> [flags] [arguments]")
+	fmt.Fprintln(os.Stderr, "\ncommands:")
+	for _, c := range commands() {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintln(os.Stderr, "\nrun 'barnes-hut <command> -help' for the flags of a command")
+}
+
+// noArgs turns one of the original example functions into a command taking no arguments
+func noArgs(f func() error) func(args []string) error {
+	return func(args []string) error {
+		if len(args) != 0 {
+			return usageError{"this command takes no arguments"}
+		}
+		return f()
+	}
+}
+
+// newFlagSet returns a flag set for the command name whose help text shows the positional arguments
+func newFlagSet(name, args, summary string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: barnes-hut %s [flags] %s\n\n%s\n\nflags:\n", name, args, summary)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseArgs parses the flags of fs and checks that exactly one positional argument remains
+func parseArgs(fs *flag.FlagSet, args []string) (string, error) {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return "", err
+		}
+		return "", usageError{err.Error()}
+	}
+	if fs.NArg() != 1 {
+		return "", usageError{fmt.Sprintf("expected exactly one file argument, got %d", fs.NArg())}
+	}
+	return fs.Arg(0), nil
+}
+
+// loadInput reads a scenario from path. A CSV or JSON bodies file is accepted as well,
+// as a scenario made only of these bodies (a JSON bodies file is a valid scenario file).
+func loadInput(path string) (*Scenario, error) {
+	if strings.ToLower(filepath.Ext(path)) == ".csv" {
+		return &Scenario{BodiesFile: path, source: path}, nil
+	}
+	return LoadScenario(path)
+}
+
+// simulationFlags are the flags overriding the parameters of a scenario
+type simulationFlags struct {
+	generations     int
+	dt              float64
+	tolerance       float64
+	theta           float64
+	integrator      string
+	multipole       string
+	solver          string
+	softening       string
+	epsilon         float64
+	frame           string
+	frameStar       int
+	workers         int
+	flatTree        bool
+	mortonOrder     bool
+	rebuildEvery    int
+	rebuildFraction float64
+	groupSize       int
+	seed            int64
+	canvasWidth     int
+	frequency       int
+	interval        float64
+	scalingFactor   float64
+	gif             string
+	png             string
+	checkpoint      string
+	checkpointEvery int
+	diagnostics     string
+	diagEvery       int
+	exactPotential  bool
+}
+
+func (f *simulationFlags) register(fs *flag.FlagSet) {
+	fs.IntVar(&f.generations, "gens", 0, "number of generations")
+	fs.Float64Var(&f.dt, "dt", 0, "time step in seconds")
+	fs.Float64Var(&f.tolerance, "tolerance", 0, "adapt each step to this fraction of the shortest time scale of the stars, -dt being the longest step")
+	fs.Float64Var(&f.theta, "theta", 0.5, "Barnes-Hut opening threshold s/d")
+	fs.StringVar(&f.integrator, "integrator", "euler", "time integrator: euler, leapfrog, verlet, rk4 or block")
+	fs.StringVar(&f.multipole, "multipole", "monopole", "expansion of accepted clusters: monopole or quadrupole")
+	fs.StringVar(&f.solver, "solver", "barnes-hut", "force solver: barnes-hut or fmm")
+	fs.StringVar(&f.softening, "softening", "none", "softening kernel: none, plummer or spline")
+	fs.Float64Var(&f.epsilon, "epsilon", 0, "softening length in meters")
+	fs.StringVar(&f.frame, "frame", "fixed", "frame of reference: fixed, center-of-mass or star")
+	fs.IntVar(&f.frameStar, "frame-star", 0, "index of the star kept at the center in the star frame")
+	fs.IntVar(&f.workers, "workers", 1, "number of goroutines computing forces")
+	fs.BoolVar(&f.flatTree, "flat-tree", false, "build a flat, allocation-free quad tree")
+	fs.BoolVar(&f.mortonOrder, "morton", false, "build the quad tree from sorted Morton keys and keep the stars in that order")
+	fs.IntVar(&f.rebuildEvery, "rebuild-every", 0, "update the quad tree in place, and rebuild it from scratch every this many updates (0: rebuild every time)")
+	fs.Float64Var(&f.rebuildFraction, "rebuild-fraction", 0.1, "with -rebuild-every, also rebuild once this fraction of the stars has changed leaf")
+	fs.IntVar(&f.groupSize, "group", 0, "walk the quad tree by groups of at most this many neighbouring stars sharing one interaction list (0: star by star)")
+	fs.Int64Var(&f.seed, "seed", 0, "seed of the galaxy generators (default: the scenario's, or drawn from the clock)")
+	fs.IntVar(&f.canvasWidth, "canvas", 500, "width of the drawn images in pixels")
+	fs.IntVar(&f.frequency, "frequency", 1000, "draw one frame every this many generations")
+	fs.Float64Var(&f.interval, "interval", 0, "draw one frame every this many simulated seconds instead of every -frequency generations")
+	fs.Float64Var(&f.scalingFactor, "scale", 1, "factor inflating the drawn size of stars")
+	fs.StringVar(&f.gif, "gif", "", "animation to write, without the .gif extension")
+	fs.StringVar(&f.png, "png", "", "image of the last generation to write")
+	fs.StringVar(&f.checkpoint, "checkpoint", "", "checkpoint file to write during the run")
+	fs.IntVar(&f.checkpointEvery, "checkpoint-every", 0, "generations between checkpoints, a multiple of -frequency; 0 for the last generation only")
+	fs.StringVar(&f.diagnostics, "diagnostics", "", "CSV file receiving energies and momenta over time")
+	fs.IntVar(&f.diagEvery, "diagnostics-every", 1, "generations between two lines of diagnostics")
+	fs.BoolVar(&f.exactPotential, "exact-potential", false, "add the O(n^2) exact potential energy to the diagnostics")
+}
+
+// apply overrides the parameters of scenario with the flags given explicitly on the command line;
+// flags left alone only fill in what the scenario does not say.
+func (f *simulationFlags) apply(fs *flag.FlagSet, scenario *Scenario) {
+	set := make(map[string]bool)
+	fs.Visit(func(fl *flag.Flag) {
+		set[fl.Name] = true
+	})
+	override := func(name string, missing bool) bool {
+		return set[name] || missing
+	}
+
+	sim := &scenario.Simulation
+	if override("gens", sim.Generations == 0) {
+		sim.Generations = f.generations
+	}
+	if override("dt", sim.TimeStep == 0) {
+		sim.TimeStep = f.dt
+	}
+	if override("tolerance", sim.Tolerance == 0) {
+		sim.Tolerance = f.tolerance
+	}
+	if override("theta", sim.Theta == nil) {
+		theta := f.theta
+		sim.Theta = &theta
+	}
+	if override("integrator", sim.Integrator == "") {
+		sim.Integrator = f.integrator
+	}
+	if override("multipole", sim.Multipole == "") {
+		sim.Multipole = f.multipole
+	}
+	if override("solver", sim.Solver == "") {
+		sim.Solver = f.solver
+	}
+	if override("softening", sim.Softening.Kind == "") {
+		sim.Softening.Kind = f.softening
+	}
+	if override("epsilon", sim.Softening.Length == 0) {
+		sim.Softening.Length = f.epsilon
+	}
+	if override("frame", sim.Frame.Kind == "") {
+		sim.Frame.Kind = f.frame
+	}
+	if set["frame-star"] {
+		sim.Frame.Star = f.frameStar
+	}
+	if override("workers", sim.Workers == 0) {
+		sim.Workers = f.workers
+	}
+	if set["flat-tree"] {
+		sim.FlatTree = f.flatTree
+	}
+	if set["morton"] {
+		sim.MortonOrder = f.mortonOrder
+	}
+	if override("rebuild-every", sim.Incremental.RebuildEvery == 0) {
+		sim.Incremental.RebuildEvery = f.rebuildEvery
+	}
+	if override("rebuild-fraction", sim.Incremental.RebuildFraction == 0) {
+		sim.Incremental.RebuildFraction = f.rebuildFraction
+	}
+	if override("group", sim.GroupSize == 0) {
+		sim.GroupSize = f.groupSize
+	}
+	if set["seed"] {
+		seed := f.seed
+		scenario.Seed = &seed
+	}
+
+	render := &scenario.Rendering
+	if override("canvas", render.CanvasWidth == 0) {
+		render.CanvasWidth = f.canvasWidth
+	}
+	if override("frequency", render.Frequency == 0) {
+		render.Frequency = f.frequency
+	}
+	if override("interval", render.Interval == 0) {
+		render.Interval = f.interval
+	}
+	if override("scale", render.ScalingFactor == 0) {
+		render.ScalingFactor = f.scalingFactor
+	}
+
+	out := &scenario.Output
+	if set["gif"] {
+		out.GIF = f.gif
+	}
+	if set["png"] {
+		out.PNG = f.png
+	}
+	if set["checkpoint"] {
+		out.Checkpoint = f.checkpoint
+	}
+	if set["checkpoint-every"] {
+		out.CheckpointEvery = f.checkpointEvery
+	}
+	if set["diagnostics"] {
+		out.Diagnostics = f.diagnostics
+	}
+	if set["diagnostics-every"] {
+		out.DiagnosticsEvery = f.diagEvery
+	}
+	if set["exact-potential"] {
+		out.ExactPotential = f.exactPotential
+	}
+}
+
+func simulateCommand(args []string) error {
+	fs := newFlagSet("simulate", "<scenario.json | bodies.csv | bodies.json>",
+		"Runs a scenario, or the bodies of an initial conditions file. Flags given explicitly override the scenario.")
+	var flags simulationFlags
+	flags.register(fs)
+	resume := fs.String("resume", "", "checkpoint to continue the run from")
+	path, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	scenario, err := loadInput(path)
+	if err != nil {
+		return err
+	}
+	flags.apply(fs, scenario)
+	scenario.resume = *resume
+	out := scenario.Output
+	if out.GIF == "" && out.PNG == "" && out.Checkpoint == "" && out.Diagnostics == "" {
+		return usageError{"nothing to write: give -gif, -png, -checkpoint or -diagnostics, or outputs in the scenario"}
+	}
+	return scenario.Run()
+}
+
+func renderCommand(args []string) error {
+	fs := newFlagSet("render", "<checkpoint>", "Draws the universe saved in a checkpoint to a PNG image.")
+	output := fs.String("o", "out.png", "image to write")
+	canvasWidth := fs.Int("canvas", 500, "width of the image in pixels")
+	scalingFactor := fs.Float64("scale", 1, "factor inflating the drawn size of stars")
+	path, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if *canvasWidth <= 0 {
+		return usageError{"-canvas must be positive"}
+	}
+
+	snapshot, err := ReadCheckpoint(path)
+	if err != nil {
+		return err
+	}
+	return SaveUniverseToPNG(snapshot.universe, *output, *canvasWidth, *scalingFactor)
+}
+
+func inspectCommand(args []string) error {
+	fs := newFlagSet("inspect", "<checkpoint | scenario.json | bodies.csv | bodies.json>",
+		"Prints a summary of the universe in a checkpoint, or of the initial universe of a scenario.")
+	path, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	var u *Universe
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv", ".json":
+		scenario, err := loadInput(path)
+		if err != nil {
+			return err
+		}
+		if u, err = scenario.Universe(); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	default:
+		snapshot, err := ReadCheckpoint(path)
+		if err != nil {
+			return err
+		}
+		u = snapshot.universe
+		fmt.Printf("generation:  %d\n", snapshot.generation)
+		fmt.Printf("time step:   %g s\n", snapshot.time)
+		fmt.Printf("time:        %g s\n", u.time)
+		fmt.Printf("theta:       %g\n", snapshot.theta)
+		fmt.Printf("escaped:     %d\n", u.escaped)
+	}
+
+	var mass float64
+	for _, s := range u.stars {
+		mass += s.mass
+	}
+	box := BoundingQuadrant(u)
+	if u.seeded {
+		fmt.Printf("seed:        %d\n", u.seed)
+	}
+	fmt.Printf("width:       %g m\n", u.width)
+	fmt.Printf("stars:       %d\n", len(u.stars))
+	fmt.Printf("total mass:  %g kg\n", mass)
+	fmt.Printf("bounding box: (%g, %g) to (%g, %g)\n", box.x, box.y, box.x+box.width, box.y+box.width)
+	return nil
+}
+
+func benchCommand(args []string) error {
+	fs := newFlagSet("bench", "<scenario.json | bodies.csv | bodies.json>",
+		"Times a few generations of a scenario, without drawing or writing anything.")
+	var flags simulationFlags
+	flags.register(fs)
+	path, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if flags.generations == 0 {
+		flags.generations = 10
+		fs.Set("gens", "10")
+	}
+
+	scenario, err := loadInput(path)
+	if err != nil {
+		return err
+	}
+	flags.apply(fs, scenario)
+	u, err := scenario.Universe()
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	settings, err := scenario.Settings()
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+
+	numGens := scenario.Simulation.Generations
+	start := time.Now()
+	_, err = EvolveUniverse(u, numGens, numGens, settings, func(generation int, u *Universe) error {
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	elapsed := time.Since(start)
+
+	fmt.Printf("%d stars, %d generations, %d workers: %v (%v per generation)\n",
+		len(u.stars), numGens, settings.workers, elapsed, elapsed/time.Duration(numGens))
+	return nil
+}
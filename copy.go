@@ -4,10 +4,17 @@ func CopyUniverse(currentUniverse *Universe) *Universe {
 	var newUniverse Universe
 
 	newUniverse.width = currentUniverse.width
+	newUniverse.escaped = currentUniverse.escaped
+	newUniverse.seed = currentUniverse.seed
+	newUniverse.seeded = currentUniverse.seeded
+	newUniverse.time = currentUniverse.time
 	newUniverse.stars = make([]*Star, len(currentUniverse.stars))
 
 	for i := range newUniverse.stars {
 		newUniverse.stars[i] = CopyStar(currentUniverse.stars[i])
+		if currentUniverse.stars[i] == currentUniverse.followed {
+			newUniverse.followed = newUniverse.stars[i]
+		}
 	}
 
 	return &newUniverse
@@ -1,11 +1,21 @@
 package main
 
+import (
+	"io"
+)
+
 // Universe contains a slice of pointers to stars and a width parameter.
 // We conceptualize the universe as a square -- stars may go outside the universe
 // but the width dictates relative distances when drawing the universe.
 type Universe struct {
-	stars []*Star
-	width float64
+	stars   []*Star
+	width   float64
+	escaped int   // stars found outside [0, width] at the end of the generation that produced this universe
+	seed    int64 // seed of the random generator the initial conditions were drawn with, if seeded
+	seeded  bool
+	time    float64 // simulated time elapsed since the initial universe, in seconds
+
+	followed *Star // star kept at the center by a StarFrame, see FollowStar; nil once it has left the universe
 }
 
 // AddBody adds a body to the universe
@@ -39,10 +49,15 @@ type QuadTree struct {
 //Node object contains a slice of children (this could just as easily be an array of length 4).
 //A node refers to a star. Sometimes, the star will be a "dummy" star, sometimes it is a star in the
 //universe, and sometimes it is nil. Every internal node points to a dummy star.
+//A leaf at the maximum depth of the tree may hold several stars in its bucket; its star is then a dummy as well.
 type Node struct {
-	children []*Node
-	star     *Star
-	sector   Quadrant
+	parent     *Node //nil for the root
+	children   []*Node
+	star       *Star
+	sector     Quadrant
+	bucket     []*Star
+	quadrupole Quadrupole     //quadrupole moment of the stars below an internal node about its center of mass
+	local      LocalExpansion //field of the far away clusters about the center of the sector, set by FMMAccelerations
 }
 
 //Quadrant is an object representing a sub-square within a larger universe.
@@ -52,3 +67,102 @@ type Quadrant struct {
 	y     float64 //bottom right corner y coordinate
 	width float64
 }
+
+//Settings collects the parameters that control how a universe is evolved.
+type Settings struct {
+	time       float64        //length of a single time step; the longest step when tolerance is set
+	tolerance  float64        //when positive, each step is tolerance times the shortest time scale of the stars, see StepSize
+	theta      float64        //threshold on s/d above which a cluster is opened in the quad tree walk
+	multipole  MultipoleOrder //terms of the expansion used for the clusters accepted in the quad tree walk
+	integrator Integrator     //scheme used to advance positions and velocities
+	softening  Softening      //smoothing of the gravity force at short distances
+
+	maxDepth    int              //depth past which the quad tree stops splitting quadrants
+	coincident  CoincidentPolicy //what to do with stars that still share a quadrant at maxDepth
+	mergeRadius float64          //stars closer than this are merged under MergeCoincident; the softening length when 0
+
+	boundary BoundaryPolicy //what to do with stars that leave [0, width]
+	frame    Frame          //what is kept at the center of the canvas
+
+	workers      int       //number of goroutines computing forces; 1 or less means serial
+	parallelTree bool      //build the four top-level quadrants of the tree concurrently
+	mortonOrder  bool      //build the quad tree from sorted Morton keys, and keep u.stars in Morton order
+	flatTree     bool      //use a FlatTree, rebuilt in arena every time, instead of a tree of Node pointers
+	arena        *FlatTree //memory of the flat tree, allocated by DefaultSettings and shared by every copy of the settings
+
+	rebuildEvery    int              //when positive, the tree of Node pointers is updated in place, and rebuilt from scratch every rebuildEvery updates
+	rebuildFraction float64          //when positive, the updated tree is also rebuilt once this fraction of the stars has changed leaf
+	incremental     *IncrementalTree //the tree kept from one update to the next, allocated by DefaultSettings
+	solver          ForceSolver      //Barnes-Hut walk or fast multipole method, on the tree of Node pointers
+	groupSize       int              //when positive, the tree of Node pointers is walked by groups of at most groupSize stars, see GroupAccelerations
+
+	diagnostics      io.Writer //where the diagnostics time series is written as CSV, nil for none
+	diagnosticsEvery int       //generations between two lines of diagnostics
+	exactPotential   bool      //also compute the O(n^2) exact potential energy in the diagnostics
+}
+
+//SofteningKind selects the kernel used to smooth gravity at short distances.
+type SofteningKind int
+
+const (
+	NoSoftening      SofteningKind = iota //plain Newtonian gravity
+	PlummerSoftening                      //force of a Plummer sphere of scale epsilon
+	SplineSoftening                       //cubic spline kernel, exactly Newtonian beyond 2.8*epsilon
+)
+
+//Softening describes how close encounters are smoothed: which kernel and over what length (in meters).
+type Softening struct {
+	kind    SofteningKind
+	epsilon float64
+}
+
+//CoincidentPolicy decides what happens to stars that cannot be separated within the maximum depth of the quad tree.
+type CoincidentPolicy int
+
+const (
+	BucketCoincident CoincidentPolicy = iota //keep them together in a bucket leaf and sum their forces directly
+	MergeCoincident                          //merge them into a single star, conserving mass and momentum
+	ErrorCoincident                          //stop the simulation with an error
+)
+
+//BoundaryPolicy decides what happens to stars found outside [0, width] at the end of a generation.
+type BoundaryPolicy int
+
+const (
+	OpenBoundary    BoundaryPolicy = iota //leave them where they are; the quad tree grows to cover them
+	DropBoundary                          //remove them from the universe
+	ReflectBoundary                       //mirror them back inside and reverse their velocity across the edge
+	WrapBoundary                          //bring them back from the opposite edge
+)
+
+//FrameKind selects what the universe is kept centered on.
+type FrameKind int
+
+const (
+	FixedFrame        FrameKind = iota //leave the stars where the integrator puts them
+	CenterOfMassFrame                  //keep the center of mass of all stars at the center of the canvas
+	StarFrame                          //keep one star, such as a black hole, at the center of the canvas
+)
+
+//Frame describes the frame of reference of the universe: its kind, and for StarFrame the index of the star in the
+//initial u.stars. From there on the star is followed by identity, whatever its index, see FollowStar.
+type Frame struct {
+	kind FrameKind
+	star int
+}
+
+//MultipoleOrder selects how far the field of a cluster of stars is expanded when it is treated as a whole.
+type MultipoleOrder int
+
+const (
+	MonopoleOrder   MultipoleOrder = iota //a single star of the total mass at the center of mass
+	QuadrupoleOrder                       //the monopole plus the quadrupole moment of the cluster
+)
+
+//ForceSolver selects how the forces are computed from the quad tree of Node pointers.
+type ForceSolver int
+
+const (
+	BarnesHutSolver ForceSolver = iota //every star walks the tree, see ComputeNetForce: O(N log N)
+	FMMSolver                          //clusters interact with clusters, see FMMAccelerations: O(N)
+)
@@ -0,0 +1,182 @@
+/*
+	stores the conserved quantities used to tell whether a run can be trusted
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+// Diagnostics are the global quantities of a universe at one generation.
+// Energies are in joules, momentum in kg.m/s and angular momentum (about the center of mass) in kg.m^2/s.
+type Diagnostics struct {
+	generation      int
+	kinetic         float64
+	potential       float64 // exact pairwise sum, or NaN when it was skipped
+	potentialTree   float64 // the same sum, approximated with the quad tree
+	momentum        OrderedPair
+	angularMomentum float64
+	escaped         int
+}
+
+// diagnosticsHeader names the columns written by WriteCSV
+const diagnosticsHeader = "generation,kinetic,potential,potential_tree,total_energy,momentum_x,momentum_y,angular_momentum,virial_ratio,escaped"
+
+// ComputeDiagnostics computes the diagnostics of u. The exact potential energy costs O(n^2) and is only computed if exact is true.
+func ComputeDiagnostics(u *Universe, generation int, settings *Settings, exact bool) (Diagnostics, error) {
+	d := Diagnostics{
+		generation:      generation,
+		kinetic:         KineticEnergy(u),
+		potential:       math.NaN(),
+		momentum:        Momentum(u),
+		angularMomentum: AngularMomentum(u),
+		escaped:         u.escaped,
+	}
+	if exact {
+		d.potential = PotentialEnergy(u, settings.softening)
+	}
+
+	var err error
+	d.potentialTree, err = TreePotentialEnergy(u, settings)
+	return d, err
+}
+
+// TotalEnergy is the kinetic plus the potential energy, using the exact potential when available.
+func (d Diagnostics) TotalEnergy() float64 {
+	if math.IsNaN(d.potential) {
+		return d.kinetic + d.potentialTree
+	}
+	return d.kinetic + d.potential
+}
+
+// VirialRatio is 2K/|W|, which is 1 for a system in equilibrium.
+func (d Diagnostics) VirialRatio() float64 {
+	return 2 * d.kinetic / math.Abs(d.TotalEnergy()-d.kinetic)
+}
+
+// WriteCSV writes d as one line of the CSV file described by diagnosticsHeader.
+func (d Diagnostics) WriteCSV(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "%d,%g,%g,%g,%g,%g,%g,%g,%g,%d\n",
+		d.generation, d.kinetic, d.potential, d.potentialTree, d.TotalEnergy(),
+		d.momentum.x, d.momentum.y, d.angularMomentum, d.VirialRatio(), d.escaped)
+	return err
+}
+
+// KineticEnergy sums 1/2 m v^2 over the stars of u.
+func KineticEnergy(u *Universe) float64 {
+	var k float64
+	for _, s := range u.stars {
+		k += 0.5 * s.mass * (s.velocity.x*s.velocity.x + s.velocity.y*s.velocity.y)
+	}
+	return k
+}
+
+// PotentialEnergy sums the softened potential energy of every pair of stars of u.
+func PotentialEnergy(u *Universe, softening Softening) float64 {
+	var w float64
+	for i, s1 := range u.stars {
+		for _, s2 := range u.stars[i+1:] {
+			d := Dist(s1, s2)
+			if d == 0 && softening.kind == NoSoftening {
+				continue
+			}
+			w -= G * s1.mass * s2.mass * softening.Potential(d)
+		}
+	}
+	return w
+}
+
+// TreePotentialEnergy approximates PotentialEnergy with the same quad tree walk as the forces.
+func TreePotentialEnergy(u *Universe, settings *Settings) (float64, error) {
+	qt, err := BuildQuadTree(u, settings)
+	if err != nil {
+		return 0, err
+	}
+	AssignClusterPos(qt.root)
+
+	var w float64
+	for _, s := range u.stars {
+		w += ComputeNetPotential(qt, s, settings)
+	}
+	// every pair was counted from both sides
+	return w / 2, nil
+}
+
+// ComputeNetPotential is the potential energy of star in the field of all other stars, walking the tree like ComputeNetForce.
+func ComputeNetPotential(qt *QuadTree, star *Star, settings *Settings) float64 {
+	var w float64
+	pair := func(other *Star) {
+		d := Dist(star, other)
+		if d != 0 || settings.softening.kind != NoSoftening {
+			w -= G * star.mass * other.mass * settings.softening.Potential(d)
+		}
+	}
+
+	var queue []*Node = []*Node{qt.root}
+	for len(queue) != 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		if current.bucket != nil {
+			for _, b := range current.bucket {
+				if b != star {
+					pair(b)
+				}
+			}
+		} else if current.children == nil {
+			if current.star != star {
+				pair(current.star)
+			}
+		} else if Theta(current, star) > settings.theta || (settings.multipole >= QuadrupoleOrder && Dist(current.star, star) <= current.ExpansionRadius()) {
+			for _, c := range current.children {
+				if c != nil {
+					queue = append(queue, c)
+				}
+			}
+		} else {
+			pair(current.star)
+			if settings.multipole >= QuadrupoleOrder {
+				w += star.mass * current.quadrupole.Potential(OrderedPair{star.position.x - current.star.position.x, star.position.y - current.star.position.y})
+			}
+		}
+	}
+	return w
+}
+
+// Momentum sums m v over the stars of u.
+func Momentum(u *Universe) OrderedPair {
+	var p OrderedPair
+	for _, s := range u.stars {
+		p.x += s.mass * s.velocity.x
+		p.y += s.mass * s.velocity.y
+	}
+	return p
+}
+
+// AngularMomentum sums m (x vy - y vx) over the stars of u, positions and velocities taken relative to the center
+// of mass: the angular momentum about the center of mass, perpendicular to the plane. Unlike the angular momentum
+// about the origin, it does not change when Recenter translates the stars, whatever the frame.
+func AngularMomentum(u *Universe) float64 {
+	c, w := Galaxy(u.stars).CenterOfMass()
+	var l float64
+	for _, s := range u.stars {
+		x, y := s.position.x-c.x, s.position.y-c.y
+		l += s.mass * (x*(s.velocity.y-w.y) - y*(s.velocity.x-w.x))
+	}
+	return l
+}
+
+// recordDiagnostics writes the diagnostics of u to settings.diagnostics if the generation is one to record.
+func (settings *Settings) recordDiagnostics(generation int, u *Universe) error {
+	if settings.diagnostics == nil || generation%settings.diagnosticsEvery != 0 {
+		return nil
+	}
+	d, err := ComputeDiagnostics(u, generation, settings, settings.exactPotential)
+	if err != nil {
+		return err
+	}
+	return d.WriteCSV(settings.diagnostics)
+}
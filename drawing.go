@@ -1,8 +1,13 @@
 package main
 
 import (
+	"bufio"
 	"canvas"
+	"fmt"
 	"image"
+	"image/png"
+	"math"
+	"os"
 )
 
 //AnimateSystem takes a slice of Universe objects along with a canvas width
@@ -23,6 +28,18 @@ func AnimateSystem(timePoints []*Universe, canvasWidth, frequency int, scalingFa
 	return images
 }
 
+//AnimateSystemByTime is AnimateSystem with frames at uniform simulated time instead of uniform generation index,
+//for runs with an adaptive time step: a frame is drawn from the first universe reaching every multiple of interval
+//seconds. When a single step crosses several multiples, only one frame is drawn for them.
+func AnimateSystemByTime(timePoints []*Universe, canvasWidth int, interval, scalingFactor float64) []image.Image {
+	images := make([]image.Image, 0)
+	emit := AnimateStreamByTime(&images, canvasWidth, interval, scalingFactor)
+	for i, u := range timePoints {
+		emit(i, u)
+	}
+	return images
+}
+
 //DrawToCanvas generates the image corresponding to a canvas after drawing a Universe
 //object's bodies on a square canvas that is canvasWidth pixels x canvasWidth pixels.
 //A scaling factor is needed to make the stars big enough to see them.
@@ -47,3 +64,48 @@ func (u *Universe) DrawToCanvas(canvasWidth int, scalingFactor float64) image.Im
 	// we want to return an image!
 	return canvas.GetImage(c)
 }
+
+//AnimateStream returns a SnapshotFunc that draws every Universe it receives on a canvasWidth x canvasWidth canvas
+//and appends the image to images. Passed to EvolveUniverse with a stride equal to the frequency of AnimateSystem,
+//it produces the same frames without keeping every generation in memory.
+func AnimateStream(images *[]image.Image, canvasWidth int, scalingFactor float64) SnapshotFunc {
+	return func(generation int, u *Universe) error {
+		*images = append(*images, u.DrawToCanvas(canvasWidth, scalingFactor))
+		return nil
+	}
+}
+
+//AnimateStreamByTime is AnimateStream with frames at uniform simulated time, as in AnimateSystemByTime.
+//It should receive every generation, so it is passed to EvolveUniverse with a stride of 1.
+func AnimateStreamByTime(images *[]image.Image, canvasWidth int, interval, scalingFactor float64) SnapshotFunc {
+	next := math.Inf(-1)
+	return func(generation int, u *Universe) error {
+		if u.time >= next {
+			*images = append(*images, u.DrawToCanvas(canvasWidth, scalingFactor))
+			next = (math.Floor(u.time/interval) + 1) * interval
+		}
+		return nil
+	}
+}
+
+//SaveUniverseToPNG draws u on a canvasWidth x canvasWidth canvas and saves it as a PNG file.
+//Unlike Canvas.SaveToPNG, which exits the program, it returns the errors of creating and writing the file.
+func SaveUniverseToPNG(u *Universe, filename string, canvasWidth int, scalingFactor float64) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	b := bufio.NewWriter(f)
+	if err := png.Encode(b, u.DrawToCanvas(canvasWidth, scalingFactor)); err != nil {
+		f.Close()
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	if err := b.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	return nil
+}
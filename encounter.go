@@ -0,0 +1,96 @@
+/*
+	stores the setup of encounters: two galaxies placed on the two-body orbit that brings them together,
+	instead of pushing them by hand
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Encounter describes the orbit of two galaxies about their common center of mass. The galaxies are treated
+// as point masses of mass1 and mass2 (their total masses, halos included) on a conic of the given pericenter
+// distance and eccentricity: bound for eccentricity < 1, parabolic for 1 and hyperbolic above. They start
+// separation apart, on the way in to pericenter, which lies along the x axis.
+type Encounter struct {
+	mass1, mass2 float64
+	pericenter   float64
+	eccentricity float64
+	separation   float64
+
+	// center is where the center of mass of the pair is placed; the pair as a whole is at rest
+	center OrderedPair
+
+	// inclination1 and inclination2 tilt the disks out of the orbital plane about the x axis, by an angle in radians:
+	// the disks are seen in projection, their y extent and velocities shrunk by the cosine of the inclination.
+	inclination1, inclination2 float64
+	// retrograde1 and retrograde2 reverse the spin of a galaxy. The orbit and the galaxies of InitializeGalaxy
+	// and InitializeModelGalaxy all turn counterclockwise, so reversed galaxies rotate against the orbit.
+	retrograde1, retrograde2 bool
+}
+
+// SetupEncounter moves g1 and g2, as generated anywhere, onto the orbit described by e. Each galaxy keeps its
+// internal motion: only the position and velocity of its center of mass change, after it has been inclined
+// and its spin reversed as asked. Stars are changed in place.
+func SetupEncounter(g1, g2 Galaxy, e Encounter) error {
+	if !(e.mass1 > 0) || !(e.mass2 > 0) {
+		return fmt.Errorf("encounter: masses must be positive")
+	}
+	if !(e.pericenter > 0) || !(e.eccentricity >= 0) {
+		return fmt.Errorf("encounter: pericenter must be positive and eccentricity non-negative")
+	}
+	if len(g1) == 0 || len(g2) == 0 {
+		return fmt.Errorf("encounter: galaxies must have stars")
+	}
+
+	r, v, err := e.relativeOrbit()
+	if err != nil {
+		return err
+	}
+
+	// each galaxy moves about the center of mass in proportion to the mass of the other
+	m := e.mass1 + e.mass2
+	f1, f2 := e.mass2/m, e.mass1/m
+
+	g1.Incline(e.inclination1)
+	g2.Incline(e.inclination2)
+	if e.retrograde1 {
+		g1.FlipSpin()
+	}
+	if e.retrograde2 {
+		g2.FlipSpin()
+	}
+	g1.MoveTo(OrderedPair{e.center.x - f1*r.x, e.center.y - f1*r.y}, OrderedPair{-f1 * v.x, -f1 * v.y})
+	g2.MoveTo(OrderedPair{e.center.x + f2*r.x, e.center.y + f2*r.y}, OrderedPair{f2 * v.x, f2 * v.y})
+	return nil
+}
+
+// relativeOrbit returns the position and velocity of the second galaxy relative to the first at the start of the encounter
+func (e Encounter) relativeOrbit() (OrderedPair, OrderedPair, error) {
+	q, ecc, d := e.pericenter, e.eccentricity, e.separation
+	p := q * (1 + ecc) // semi-latus rectum
+
+	// true anomaly f of the starting point, from d = p / (1 + e cos f), negative so the galaxies are approaching
+	var f float64
+	if ecc == 0 {
+		if d != 0 && math.Abs(d-q)/q > 1e-9 {
+			return OrderedPair{}, OrderedPair{}, fmt.Errorf("encounter: a circular orbit keeps the galaxies %g apart, not %g", q, d)
+		}
+	} else {
+		if d < q {
+			return OrderedPair{}, OrderedPair{}, fmt.Errorf("encounter: separation %g is less than the pericenter %g", d, q)
+		}
+		if ecc < 1 && d > p/(1-ecc) {
+			return OrderedPair{}, OrderedPair{}, fmt.Errorf("encounter: separation %g is more than the apocenter %g", d, p/(1-ecc))
+		}
+		f = -math.Acos(math.Min(1, (p/d-1)/ecc))
+	}
+
+	rf := p / (1 + ecc*math.Cos(f))
+	h := math.Sqrt(G * (e.mass1 + e.mass2) / p)
+	r := OrderedPair{rf * math.Cos(f), rf * math.Sin(f)}
+	v := OrderedPair{-h * math.Sin(f), h * (ecc + math.Cos(f))}
+	return r, v, nil
+}
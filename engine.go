@@ -1,43 +1,324 @@
 package main
 
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
 //BarnesHut is our highest level function.
 //Input: initial Universe object, a number of generations, and a time interval.
 //Output: collection of Universe objects corresponding to updating the system
 //over indicated number of generations every given time interval.
+//The universe is evolved with the explicit Euler scheme; use BarnesHutWithSettings to pick another integrator.
 func BarnesHut(initialUniverse *Universe, numGens int, time, theta float64) []*Universe {
-	timePoints := make([]*Universe, numGens+1)
-	timePoints[0] = initialUniverse
+	timePoints, err := BarnesHutWithSettings(initialUniverse, numGens, DefaultSettings(time, theta))
+	if err != nil {
+		// the default settings bucket coincident stars, so the tree never reports an error
+		panic(err)
+	}
+	return timePoints
+}
+
+//BarnesHutWithSettings is BarnesHut with every simulation parameter (time step, theta, integrator...) taken from settings.
+//It keeps every generation in memory; use EvolveUniverse to only look at some of them.
+func BarnesHutWithSettings(initialUniverse *Universe, numGens int, settings *Settings) ([]*Universe, error) {
+	timePoints := make([]*Universe, 0, numGens+1)
+	_, err := EvolveUniverse(initialUniverse, numGens, 1, settings, func(generation int, u *Universe) error {
+		// add the new universe to timePoints
+		timePoints = append(timePoints, u)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return timePoints, nil
+}
 
-	for i := 1; i <= numGens; i++ {
-		// update universe and add the new universe to timePoints
-		timePoints[i] = UpdateUniverse(timePoints[i-1], time, theta)
+//SnapshotFunc receives a generation number and the universe at that generation.
+//The universe is never modified afterwards, so it may be kept. Returning an error stops the run.
+type SnapshotFunc func(generation int, u *Universe) error
 
+//EvolveUniverse evolves initialUniverse over numGens generations while holding only the current universe in memory.
+//Every stride-th generation, starting with the initial universe at generation 0, is passed to emit.
+//It returns the universe of the last generation, whether or not it was emitted.
+//Unless settings.frame is FixedFrame, the initial universe is first brought to rest and recentered, see Recenter.
+func EvolveUniverse(initialUniverse *Universe, numGens, stride int, settings *Settings, emit SnapshotFunc) (*Universe, error) {
+	if stride < 1 {
+		return nil, fmt.Errorf("snapshot stride must be positive, got %d", stride)
 	}
-	return timePoints
+	current := CopyUniverse(initialUniverse)
+	if settings.frame.kind != FixedFrame {
+		ZeroMomentum(current)
+		if err := FollowStar(current, settings.frame); err != nil {
+			return nil, err
+		}
+		if err := Recenter(current, settings.frame); err != nil {
+			return nil, err
+		}
+	}
+	if err := settings.integrator.Start(current, settings); err != nil {
+		return nil, err
+	}
+	return continueUniverse(current, 0, numGens, stride, settings, emit)
 }
 
-// UpdateUniverse updates the current universe after a time t; it returns a pointer to the updated universe
-func UpdateUniverse(currentUniverse *Universe, t, theta float64) *Universe {
+//continueUniverse evolves current, which is at the given generation, up to generation numGens.
+func continueUniverse(current *Universe, generation, numGens, stride int, settings *Settings, emit SnapshotFunc) (*Universe, error) {
+	if settings.diagnostics != nil {
+		if settings.diagnosticsEvery < 1 {
+			return nil, fmt.Errorf("diagnostics interval must be positive, got %d", settings.diagnosticsEvery)
+		}
+		if _, err := fmt.Fprintln(settings.diagnostics, diagnosticsHeader); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := generation; i <= numGens; i++ {
+		if i > generation {
+			next, err := UpdateUniverse(current, settings)
+			if err != nil {
+				return nil, fmt.Errorf("generation %d: %v", i, err)
+			}
+			current = next
+		}
+
+		if err := settings.recordDiagnostics(i, current); err != nil {
+			return nil, fmt.Errorf("generation %d: diagnostics: %v", i, err)
+		}
+		if i%stride == 0 {
+			if err := emit(i, current); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return current, nil
+}
+
+//DefaultMaxDepth is the default depth limit of the quad tree. Halving the universe this many times
+//goes below the resolution of float64 positions, so stars still sharing a quadrant are effectively coincident.
+const DefaultMaxDepth = 64
+
+//DefaultSettings returns the settings used by BarnesHut: the explicit Euler scheme with the given time step and theta.
+//The settings hold the memory of the flat and incremental trees, so two runs at the same time need settings of their own.
+func DefaultSettings(time, theta float64) *Settings {
+	return &Settings{
+		time:       time,
+		theta:      theta,
+		integrator: Euler{},
+		maxDepth:   DefaultMaxDepth,
+		coincident: BucketCoincident,
+		workers:    1,
+
+		// memory kept from one force evaluation to the next, and shared by every copy of the settings
+		arena:       &FlatTree{},
+		incremental: &IncrementalTree{},
+	}
+}
+
+// UpdateUniverse updates the current universe after a time step; it returns a pointer to the updated universe
+func UpdateUniverse(currentUniverse *Universe, settings *Settings) (*Universe, error) {
 	newUniverse := CopyUniverse(currentUniverse)
 
-	// construct the quad tree HERE. Doing this anywhere else is going to cause problems. SERIOUS problems. Problems that took hours to resolve.
-	qt := BuildQuadTree(newUniverse)
-	AssignClusterPos(qt.root)
+	if settings.coincident == MergeCoincident {
+		if err := MergeCoincidentStars(newUniverse, settings); err != nil {
+			return nil, err
+		}
+	}
+
+	if settings.mortonOrder {
+		SortStarsByMorton(newUniverse)
+	}
+
+	// the integrator moves the stars of the copy; currentUniverse is left untouched
+	dt := settings.StepSize(newUniverse)
+	if err := settings.integrator.Step(newUniverse, dt, settings); err != nil {
+		return nil, err
+	}
+	newUniverse.time += dt
+	// recenter before the boundary is applied, so stars are judged against the recentered canvas
+	if err := Recenter(newUniverse, settings.frame); err != nil {
+		return nil, err
+	}
+	newUniverse.escaped = ApplyBoundary(newUniverse, settings.boundary)
+
+	return newUniverse, nil
+}
+
+// ComputeAccelerations builds the quad tree for the current positions of u and returns the acceleration of every star, indexed like u.stars.
+// Every acceleration is computed before anything moves: the leaves of the tree point at the stars of u.
+func ComputeAccelerations(u *Universe, settings *Settings) ([]OrderedPair, error) {
+	return ComputeAccelerationsOf(u, u.stars, settings)
+}
+
+// ComputeAccelerationsOf builds the quad tree for the current positions of all stars of u, but only walks it for
+// the given stars, which must belong to u. It returns their accelerations, indexed like stars.
+func ComputeAccelerationsOf(u *Universe, stars []*Star, settings *Settings) ([]OrderedPair, error) {
+	var accel func(s *Star) OrderedPair
+	if err := checkTreeOptions(settings); err != nil {
+		return nil, err
+	}
+	if settings.flatTree {
+		arena := settings.arena
+		if arena == nil {
+			// settings not made by DefaultSettings: the memory is not kept, but the settings are left untouched
+			arena = &FlatTree{}
+		}
+		if err := arena.Build(u, settings); err != nil {
+			return nil, err
+		}
+		accel = func(s *Star) OrderedPair {
+			return arena.Acceleration(s, settings)
+		}
+	} else {
+		var qt *QuadTree
+		var err error
+		if settings.rebuildEvery > 0 && settings.incremental != nil {
+			qt, err = settings.incremental.Update(u, settings)
+		} else if qt, err = BuildQuadTree(u, settings); err == nil {
+			AssignClusterPos(qt.root)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if settings.solver == FMMSolver {
+			return FMMAccelerations(qt, stars, settings), nil
+		}
+		if settings.groupSize > 0 {
+			return GroupAccelerations(qt, stars, settings), nil
+		}
+		accel = func(s *Star) OrderedPair {
+			return s.NewAccel(qt, settings)
+		}
+	}
+
+	acc := make([]OrderedPair, len(stars))
+	if settings.workers <= 1 {
+		for i, s := range stars {
+			acc[i] = accel(s)
+		}
+		return acc, nil
+	}
 
-	for s := range currentUniverse.stars {
-		// update pos, vel and accel
-		newUniverse.stars[s].Update(qt, currentUniverse, t, theta)
+	// the tree is read-only from here on, so every worker can walk it for its own share of the stars
+	var wg sync.WaitGroup
+	chunk := (len(stars) + settings.workers - 1) / settings.workers
+	for start := 0; start < len(stars); start += chunk {
+		end := start + chunk
+		if end > len(stars) {
+			end = len(stars)
+		}
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				acc[i] = accel(stars[i])
+			}
+		}(start, end)
+	}
+	wg.Wait()
+	return acc, nil
+}
 
+// SetAccelerations stores in every star of u the acceleration at its current position
+func SetAccelerations(u *Universe, settings *Settings) error {
+	acc, err := ComputeAccelerations(u, settings)
+	if err != nil {
+		return err
 	}
-	return newUniverse
+	for i, s := range u.stars {
+		s.acceleration = acc[i]
+	}
+	return nil
 }
 
-// need to change this to use current acc/vel/pos
-func (s *Star) Update(qt *QuadTree, univ *Universe, t, theta float64) {
-	acc := s.NewAccel(qt, univ, theta)
-	vel := s.NewVelocity(t)
-	pos := s.NewPosition(t)
-	s.acceleration, s.velocity, s.position = acc, vel, pos
+// MergeCoincidentStars merges every star with the stars closer to it than the merge radius of settings, and with
+// the stars sharing its bucket of the quad tree, which can not be told apart. The merged star sits at the center
+// of mass of its group and conserves its mass and momentum. Distances are those before any merge.
+func MergeCoincidentStars(u *Universe, settings *Settings) error {
+	bucketSettings := *settings
+	bucketSettings.coincident = BucketCoincident
+	qt, err := BuildQuadTree(u, &bucketSettings)
+	if err != nil {
+		return err
+	}
+
+	// merging moves the stars: neighbours are searched at the positions they had before
+	before := make(map[*Star]OrderedPair, len(u.stars))
+	for _, s := range u.stars {
+		before[s] = s.position
+	}
+	radius := settings.MergeRadius()
+	// the sectors deep in the tree are a few ulps of the root off, far more than their width
+	slack := 1e-9 * qt.root.sector.width
+
+	// absorbed stars are marked by their merged partner
+	absorbed := make(map[*Star]bool)
+	for _, s := range u.stars {
+		if absorbed[s] {
+			continue
+		}
+		for _, other := range qt.root.neighbours(before[s], radius, slack, before, nil) {
+			if other != s && !absorbed[other] {
+				s.Merge(other)
+				absorbed[other] = true
+				if other == u.followed {
+					u.followed = s
+				}
+			}
+		}
+	}
+
+	if len(absorbed) == 0 {
+		return nil
+	}
+	stars := make([]*Star, 0, len(u.stars)-len(absorbed))
+	for _, s := range u.stars {
+		if !absorbed[s] {
+			stars = append(stars, s)
+		}
+	}
+	u.stars = stars
+	return nil
+}
+
+// neighbours appends to found the stars below n within radius of p, at the positions given by before, and every
+// star of a bucket whose sector is within radius of p, give or take slack
+func (n *Node) neighbours(p OrderedPair, radius, slack float64, before map[*Star]OrderedPair, found []*Star) []*Star {
+	if n.sector.distance(p) > radius+slack {
+		return found
+	}
+	if n.bucket != nil {
+		return append(found, n.bucket...)
+	}
+	if n.children == nil {
+		if q := before[n.star]; math.Hypot(q.x-p.x, q.y-p.y) <= radius {
+			found = append(found, n.star)
+		}
+		return found
+	}
+	for _, c := range n.children {
+		if c != nil {
+			found = c.neighbours(p, radius, slack, before, found)
+		}
+	}
+	return found
+}
+
+// distance returns the distance from p to the square q, 0 inside it
+func (q Quadrant) distance(p OrderedPair) float64 {
+	dx := math.Max(0, math.Max(q.x-p.x, p.x-q.x-q.width))
+	dy := math.Max(0, math.Max(q.y-p.y, p.y-q.y-q.width))
+	return math.Hypot(dx, dy)
+}
+
+// MergeRadius is the distance below which MergeCoincident merges two stars: mergeRadius when it is set, and the
+// softening length otherwise, below which the forces are smoothed anyway.
+func (settings *Settings) MergeRadius() float64 {
+	if settings.mergeRadius > 0 {
+		return settings.mergeRadius
+	}
+	return settings.softening.epsilon
 }
 
 /*
@@ -56,7 +337,9 @@ while queue.length != 0:
 	remove the first element from queue (queue  = queue[1:])
 */
 // ComputeNetForce sums the forces of all bodies in the universe acting on b.
-func ComputeNetForce(qt *QuadTree, star *Star, theta float64) OrderedPair {
+// Both individual stars and clusters use the softening kernel of settings.
+func ComputeNetForce(qt *QuadTree, star *Star, settings *Settings) OrderedPair {
+	theta := settings.theta
 	var netForce OrderedPair
 
 	// loop through all nodes of the quad tree in a BFS manner
@@ -66,13 +349,21 @@ func ComputeNetForce(qt *QuadTree, star *Star, theta float64) OrderedPair {
 	for len(queue) != 0 {
 		current := queue[0]
 
-		// if this is an actual star, not a dummy, we add the force it exerts on star directly to netForce
-		if current.children == nil && current.star != star {
-			F := ComputeGravityForce(star, current.star)
+		if current.bucket != nil {
+			// stars that could not be separated are summed directly
+			for _, b := range current.bucket {
+				if b != star {
+					netForce.Add(ComputeGravityForce(star, b, settings.softening))
+				}
+			}
+		} else if current.children == nil && current.star != star {
+			// if this is an actual star, not a dummy, we add the force it exerts on star directly to netForce
+			F := ComputeGravityForce(star, current.star, settings.softening)
 			netForce.Add(F)
 		} else {
 			sd := Theta(current, star)
-			if sd > theta {
+			// the quadrupole expansion only converges outside the circle around the center of mass that holds the whole cell
+			if sd > theta || (settings.multipole >= QuadrupoleOrder && Dist(current.star, star) <= current.ExpansionRadius()) {
 				// if sd > theta, we add its children to the queue to be explored later
 				for _, c := range current.children {
 					if c != nil {
@@ -81,7 +372,12 @@ func ComputeNetForce(qt *QuadTree, star *Star, theta float64) OrderedPair {
 				}
 			} else {
 				// treat the collection of stars in this subtree as a single object
-				netForce.Add(ComputeGravityForce(star, current.star))
+				netForce.Add(ComputeGravityForce(star, current.star, settings.softening))
+				// the quadrupole correction is not softened: accepted clusters are far compared to the softening length
+				if settings.multipole >= QuadrupoleOrder {
+					a := current.quadrupole.Acceleration(OrderedPair{star.position.x - current.star.position.x, star.position.y - current.star.position.y})
+					netForce.Add(OrderedPair{star.mass * a.x, star.mass * a.y})
+				}
 			}
 		}
 		queue = queue[1:]
@@ -89,6 +385,24 @@ func ComputeNetForce(qt *QuadTree, star *Star, theta float64) OrderedPair {
 	return netForce
 }
 
+// checkTreeOptions rejects the settings that ask for tree options that can not work together, instead of ignoring some of them
+func checkTreeOptions(settings *Settings) error {
+	if settings.flatTree {
+		switch {
+		case settings.solver == FMMSolver:
+			return fmt.Errorf("the FMM solver works on the tree of Node pointers, so it can not be combined with a flat tree")
+		case settings.groupSize > 0:
+			return fmt.Errorf("the group walk works on the tree of Node pointers, so it can not be combined with a flat tree")
+		case settings.rebuildEvery > 0:
+			return fmt.Errorf("the incremental tree is a tree of Node pointers, so it can not be combined with a flat tree")
+		}
+	}
+	if settings.solver == FMMSolver && settings.groupSize > 0 {
+		return fmt.Errorf("the group walk is a Barnes-Hut walk, so it can not be combined with the FMM solver")
+	}
+	return nil
+}
+
 // Computes theta = s/d = (sector width)/(distance) that determines whether individual gravitatioal effect from a cluster should be considered
 // big theta means we should probably consider the individual gravitational effect of stars in the cluster
 func Theta(n *Node, star *Star) float64 {
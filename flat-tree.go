@@ -0,0 +1,196 @@
+/*
+	stores the flat quad tree: the same tree as BuildQuadTree, kept in one slice of nodes that refer to their
+	children by index. The slices are reused from one generation to the next and the walk keeps its stack
+	in a fixed array, so a step allocates nothing once the slices have grown to the size of the universe.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// FlatTree is a quad tree stored in a contiguous slice of nodes, the root first.
+type FlatTree struct {
+	nodes []FlatNode
+	stars []*Star // stars of the universe the tree was built for
+	next  []int32 // next star of the same bucket leaf, indexed like stars; -1 ends the bucket
+}
+
+// FlatNode is a node of a FlatTree. Leaves hold the index of a star; a leaf at the maximum depth may hold
+// several, chained through FlatTree.next. Internal nodes hold the mass, center of mass and quadrupole
+// moment of the stars below them once Build is done.
+type FlatNode struct {
+	children   [4]int32 // index of every child in nodes, 0 for none (the root is nobody's child)
+	star       int32    // first star of a leaf, -1 for an internal node
+	count      int32    // number of stars of a leaf
+	sector     Quadrant
+	mass       float64
+	center     OrderedPair
+	quadrupole Quadrupole
+}
+
+// flatStackSize bounds the stack of the walk without allocating: every level of the tree leaves at most
+// three nodes behind, so it covers trees of depth DefaultMaxDepth. Deeper trees make the stack grow on the heap.
+const flatStackSize = 3*DefaultMaxDepth + 4
+
+// Build rebuilds t for the current positions of the stars of u, reusing the memory of the previous tree.
+// Stars that still share a leaf at settings.maxDepth are handled according to settings.coincident, as in
+// BuildQuadTree, except that the tree is always built serially.
+func (t *FlatTree) Build(u *Universe, settings *Settings) error {
+	t.nodes = append(t.nodes[:0], FlatNode{star: -1, sector: BoundingQuadrant(u)})
+	t.stars = u.stars
+	if cap(t.next) < len(u.stars) {
+		t.next = make([]int32, len(u.stars))
+	}
+	t.next = t.next[:len(u.stars)]
+
+	for i := range u.stars {
+		if err := t.insert(int32(i), settings); err != nil {
+			return err
+		}
+	}
+	t.assign(0)
+	return nil
+}
+
+// insert places the star of index i in the tree
+func (t *FlatTree) insert(i int32, settings *Settings) error {
+	star := t.stars[i]
+	n := int32(0)
+	for depth := 1; ; depth++ {
+		q := star.whichSubQuad(t.nodes[n].sector)
+		c := t.nodes[n].children[q]
+		if c == 0 {
+			t.next[i] = -1
+			t.nodes[n].children[q] = t.newLeaf(i, t.nodes[n].sector.findNewQuad(q))
+			return nil
+		}
+		if t.nodes[c].star < 0 {
+			n = c
+			continue
+		}
+
+		if depth >= settings.maxDepth {
+			// the leaf can not be split any further
+			if settings.coincident == ErrorCoincident {
+				other := t.stars[t.nodes[c].star]
+				return fmt.Errorf("quad tree: stars at (%g, %g) and (%g, %g) cannot be separated by a quadrant of width %g",
+					star.position.x, star.position.y, other.position.x, other.position.y, t.nodes[c].sector.width)
+			}
+			t.next[i] = t.nodes[c].star
+			t.nodes[c].star = i
+			t.nodes[c].count++
+			return nil
+		}
+
+		// turn the leaf into an internal node and move its star one level down
+		old := t.nodes[c].star
+		t.nodes[c].star, t.nodes[c].count = -1, 0
+		oq := t.stars[old].whichSubQuad(t.nodes[c].sector)
+		leaf := t.newLeaf(old, t.nodes[c].sector.findNewQuad(oq))
+		t.nodes[c].children[oq] = leaf
+		n = c
+	}
+}
+
+// newLeaf appends a leaf holding the star of index i and returns its index; it may move the nodes, so no pointer into them is kept across calls
+func (t *FlatTree) newLeaf(i int32, sector Quadrant) int32 {
+	t.nodes = append(t.nodes, FlatNode{star: i, count: 1, sector: sector})
+	return int32(len(t.nodes) - 1)
+}
+
+// assign sets the mass, center of mass and quadrupole moment of node n and of every node below it, like AssignClusterPos
+func (t *FlatTree) assign(n int32) {
+	node := &t.nodes[n]
+	node.mass = 0
+	node.center = OrderedPair{}
+	node.quadrupole = Quadrupole{}
+
+	if node.star >= 0 {
+		for i := node.star; i >= 0; i = t.next[i] {
+			s := t.stars[i]
+			node.center.x += s.mass * s.position.x
+			node.center.y += s.mass * s.position.y
+			node.mass += s.mass
+		}
+		if node.mass > 0 {
+			node.center = OrderedPair{node.center.x / node.mass, node.center.y / node.mass}
+		}
+		for i := node.star; i >= 0; i = t.next[i] {
+			s := t.stars[i]
+			node.quadrupole.AddMass(s.mass, OrderedPair{s.position.x - node.center.x, s.position.y - node.center.y})
+		}
+		return
+	}
+
+	for _, c := range node.children {
+		if c == 0 {
+			continue
+		}
+		t.assign(c)
+		child := &t.nodes[c]
+		node.center.x += child.mass * child.center.x
+		node.center.y += child.mass * child.center.y
+		node.mass += child.mass
+	}
+	if node.mass > 0 {
+		node.center = OrderedPair{node.center.x / node.mass, node.center.y / node.mass}
+	}
+	for _, c := range node.children {
+		if c != 0 {
+			child := &t.nodes[c]
+			node.quadrupole.Add(child.quadrupole, child.mass, OrderedPair{child.center.x - node.center.x, child.center.y - node.center.y})
+		}
+	}
+}
+
+// Acceleration returns the acceleration of star, one of the stars the tree was built for, walking the tree
+// with the opening rule of ComputeNetForce. It does not allocate, and may be called from several goroutines.
+func (t *FlatTree) Acceleration(star *Star, settings *Settings) OrderedPair {
+	var F OrderedPair
+	var buf [flatStackSize]int32
+	stack := append(buf[:0], 0)
+
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		node := &t.nodes[n]
+
+		if node.star >= 0 {
+			for i := node.star; i >= 0; i = t.next[i] {
+				if other := t.stars[i]; other != star {
+					F.Add(ComputeGravityForce(star, other, settings.softening))
+				}
+			}
+			continue
+		}
+
+		d := math.Hypot(node.center.x-star.position.x, node.center.y-star.position.y)
+		r := OrderedPair{star.position.x - node.center.x, star.position.y - node.center.y}
+		if node.sector.width/d > settings.theta || (settings.multipole >= QuadrupoleOrder && d <= node.expansionRadius()) {
+			for _, c := range node.children {
+				if c != 0 {
+					stack = append(stack, c)
+				}
+			}
+			continue
+		}
+
+		cell := Star{position: node.center, mass: node.mass}
+		F.Add(ComputeGravityForce(star, &cell, settings.softening))
+		if settings.multipole >= QuadrupoleOrder {
+			a := node.quadrupole.Acceleration(r)
+			F.Add(OrderedPair{star.mass * a.x, star.mass * a.y})
+		}
+	}
+	return OrderedPair{F.x / star.mass, F.y / star.mass}
+}
+
+// expansionRadius is Node.ExpansionRadius for a flat node
+func (node *FlatNode) expansionRadius() float64 {
+	dx := math.Max(node.center.x-node.sector.x, node.sector.x+node.sector.width-node.center.x)
+	dy := math.Max(node.center.y-node.sector.y, node.sector.y+node.sector.width-node.center.y)
+	return math.Hypot(dx, dy)
+}
@@ -0,0 +1,209 @@
+/*
+	stores the fast multipole method: instead of walking the tree once for every star, pairs of well separated
+	clusters interact once, the field of the source cluster being expanded about the center of the target cluster,
+	and the expansions are passed down the tree to the stars. It uses the same tree as the Barnes-Hut walk.
+*/
+
+package main
+
+import (
+	"math"
+	"sync"
+)
+
+// LocalExpansion is the acceleration field of far away clusters about the center c of the sector of a node,
+// to second order: the acceleration at x = c + dx is
+//
+//	a_i + J_ij dx_j + 1/2 T_ijk dx_j dx_k
+//
+// J being the gradient of the field and T its second derivatives. Both are symmetric in all their indices.
+type LocalExpansion struct {
+	a                      OrderedPair
+	jxx, jxy, jyy          float64
+	txxx, txxy, txyy, tyyy float64
+}
+
+// at evaluates the expansion at offset dx from its center
+func (l *LocalExpansion) at(dx OrderedPair) OrderedPair {
+	xx, xy, yy := dx.x*dx.x, dx.x*dx.y, dx.y*dx.y
+	return OrderedPair{
+		x: l.a.x + l.jxx*dx.x + l.jxy*dx.y + 0.5*(l.txxx*xx+2*l.txxy*xy+l.txyy*yy),
+		y: l.a.y + l.jxy*dx.x + l.jyy*dx.y + 0.5*(l.txxy*xx+2*l.txyy*xy+l.tyyy*yy),
+	}
+}
+
+// add adds the expansion l2, shifted to offset dx from its center, to l (L2L)
+func (l *LocalExpansion) add(l2 *LocalExpansion, dx OrderedPair) {
+	l.a.Add(l2.at(dx))
+	l.jxx += l2.jxx + l2.txxx*dx.x + l2.txxy*dx.y
+	l.jxy += l2.jxy + l2.txxy*dx.x + l2.txyy*dx.y
+	l.jyy += l2.jyy + l2.txyy*dx.x + l2.tyyy*dx.y
+	l.txxx += l2.txxx
+	l.txxy += l2.txxy
+	l.txyy += l2.txyy
+	l.tyyy += l2.tyyy
+}
+
+// center returns the center of the sector of n, the point local expansions are taken about
+func (n *Node) center() OrderedPair {
+	return OrderedPair{n.sector.x + n.sector.width/2, n.sector.y + n.sector.width/2}
+}
+
+// fmm holds the state of one evaluation of the fast multipole method
+type fmm struct {
+	settings *Settings
+	index    map[*Star]int // position of the stars wanted in acc
+	acc      []OrderedPair
+}
+
+// FMMAccelerations returns the accelerations of the given stars, which must be in the tree qt, indexed like stars.
+// AssignClusterPos must have been called on qt. The multipole expansion of a source cluster (its mass, and its
+// quadrupole moment when settings.multipole asks for it) is turned into a local expansion about the center of a
+// target cluster when the two are well separated: the sum of their widths is below theta times their distance,
+// and the target lies outside the circle where the expansion of the source converges. Local expansions are then
+// passed down to the stars. Every star of the tree is computed, even when only some are asked for.
+// With several workers, the four quadrants of the root are handled concurrently.
+func FMMAccelerations(qt *QuadTree, stars []*Star, settings *Settings) []OrderedPair {
+	f := &fmm{settings: settings, index: make(map[*Star]int, len(stars)), acc: make([]OrderedPair, len(stars))}
+	for i, s := range stars {
+		f.index[s] = i
+	}
+
+	// a target cluster only receives the interactions of its own subtree, so the quadrants of the root are independent
+	var wg sync.WaitGroup
+	for _, c := range qt.root.children {
+		if c == nil {
+			continue
+		}
+		run := func(c *Node) {
+			c.clearLocals()
+			f.interact(c, qt.root)
+			f.push(c)
+		}
+		if settings.workers <= 1 {
+			run(c)
+			continue
+		}
+		wg.Add(1)
+		go func(c *Node) {
+			defer wg.Done()
+			run(c)
+		}(c)
+	}
+	wg.Wait()
+	return f.acc
+}
+
+// clearLocals zeroes the local expansion of n and of every node below it
+func (n *Node) clearLocals() {
+	n.local = LocalExpansion{}
+	for _, c := range n.children {
+		if c != nil {
+			c.clearLocals()
+		}
+	}
+}
+
+// interact adds the field of the stars below source to the stars below target
+func (f *fmm) interact(target, source *Node) {
+	c := target.center()
+	r := OrderedPair{c.x - source.star.position.x, c.y - source.star.position.y}
+	d := math.Hypot(r.x, r.y)
+	reach := target.sector.width * math.Sqrt2 / 2 // farthest star of target from c
+	if (target.sector.width+source.sector.width) < f.settings.theta*d && d > reach+source.ExpansionRadius() {
+		f.translate(target, source, r, d)
+		return
+	}
+
+	targetLeaf, sourceLeaf := target.children == nil, source.children == nil
+	switch {
+	case targetLeaf && sourceLeaf:
+		f.direct(target, source)
+	case sourceLeaf || (!targetLeaf && target.sector.width >= source.sector.width):
+		for _, t := range target.children {
+			if t != nil {
+				f.interact(t, source)
+			}
+		}
+	default:
+		for _, s := range source.children {
+			if s != nil {
+				f.interact(target, s)
+			}
+		}
+	}
+}
+
+// translate adds to the local expansion of target the field of the multipole expansion of source, at offset r
+// and distance d from it (M2L). The terms kept are those of second order in size/distance: the quadrupole
+// moment adds to the acceleration and its gradient, but its second derivatives are left out.
+func (f *fmm) translate(target, source *Node, r OrderedPair, d float64) {
+	m := source.star.mass
+	k := f.settings.softening.Kernel(d)
+	l := &target.local
+	l.a.Add(OrderedPair{-G * m * k * r.x, -G * m * k * r.y})
+
+	d2 := d * d
+	d5 := d2 * d2 * d
+	d7 := d5 * d2
+	l.jxx += G * m * (3*r.x*r.x - d2) / d5
+	l.jxy += G * m * 3 * r.x * r.y / d5
+	l.jyy += G * m * (3*r.y*r.y - d2) / d5
+	l.txxx += G * m * (9*r.x/d5 - 15*r.x*r.x*r.x/d7)
+	l.txxy += G * m * (3*r.y/d5 - 15*r.x*r.x*r.y/d7)
+	l.txyy += G * m * (3*r.x/d5 - 15*r.x*r.y*r.y/d7)
+	l.tyyy += G * m * (9*r.y/d5 - 15*r.y*r.y*r.y/d7)
+
+	if f.settings.multipole >= QuadrupoleOrder {
+		l.a.Add(source.quadrupole.Acceleration(r))
+		xx, xy, yy := source.quadrupole.Gradient(r)
+		l.jxx += xx
+		l.jxy += xy
+		l.jyy += yy
+	}
+}
+
+// direct adds the forces of the stars of the leaf source to the stars of the leaf target, one by one (P2P)
+func (f *fmm) direct(target, source *Node) {
+	for _, star := range target.leafStars() {
+		i, ok := f.index[star]
+		if !ok {
+			continue
+		}
+		var F OrderedPair
+		for _, other := range source.leafStars() {
+			if other != star {
+				F.Add(ComputeGravityForce(star, other, f.settings.softening))
+			}
+		}
+		f.acc[i].Add(OrderedPair{F.x / star.mass, F.y / star.mass})
+	}
+}
+
+// push passes the local expansion of n down to its children (L2L), and evaluates it at the stars of the leaves (L2P)
+func (f *fmm) push(n *Node) {
+	c := n.center()
+	if n.children == nil {
+		for _, star := range n.leafStars() {
+			if i, ok := f.index[star]; ok {
+				f.acc[i].Add(n.local.at(OrderedPair{star.position.x - c.x, star.position.y - c.y}))
+			}
+		}
+		return
+	}
+	for _, child := range n.children {
+		if child != nil {
+			cc := child.center()
+			child.local.add(&n.local, OrderedPair{cc.x - c.x, cc.y - c.y})
+			f.push(child)
+		}
+	}
+}
+
+// leafStars returns the stars of the leaf n
+func (n *Node) leafStars() []*Star {
+	if n.bucket != nil {
+		return n.bucket
+	}
+	return []*Star{n.star}
+}
@@ -0,0 +1,52 @@
+/*
+	stores the frame of reference of the universe: the stars are translated so the galaxies stay on the canvas
+	instead of drifting off it
+*/
+
+package main
+
+import "fmt"
+
+// Recenter translates every star of u so that the center of frame is at the center of the canvas,
+// (width/2, width/2). The star of a StarFrame is u.followed, chosen by FollowStar; once it has left the
+// universe, the center of mass is kept at the center instead.
+// The quad tree and the drawings both use the translated positions. Following a star moves
+// the origin with it, so the angular momentum about the origin is not conserved in the star frame: the
+// diagnostics report it about the center of mass instead, see AngularMomentum.
+func Recenter(u *Universe, frame Frame) error {
+	var center OrderedPair
+	switch frame.kind {
+	case FixedFrame:
+		return nil
+	case CenterOfMassFrame:
+		center, _ = Galaxy(u.stars).CenterOfMass()
+	case StarFrame:
+		if u.followed == nil {
+			center, _ = Galaxy(u.stars).CenterOfMass()
+		} else {
+			center = u.followed.position
+		}
+	}
+	Galaxy(u.stars).Translate(OrderedPair{u.width/2 - center.x, u.width/2 - center.y})
+	return nil
+}
+
+// FollowStar makes the star of index frame.star in u the one a StarFrame keeps at the center. The star is then
+// followed through copies, mergers and reorderings of u.stars: a star absorbing it in a merger takes its place,
+// and once it is dropped by the boundary, none is followed.
+func FollowStar(u *Universe, frame Frame) error {
+	if frame.kind != StarFrame {
+		return nil
+	}
+	if frame.star < 0 || frame.star >= len(u.stars) {
+		return fmt.Errorf("frame star %d out of range, the universe has %d stars", frame.star, len(u.stars))
+	}
+	u.followed = u.stars[frame.star]
+	return nil
+}
+
+// ZeroMomentum removes the velocity of the center of mass from every star of u, so that the universe as a whole stays at rest.
+func ZeroMomentum(u *Universe) {
+	_, w := Galaxy(u.stars).CenterOfMass()
+	push((*Galaxy)(&u.stars), OrderedPair{-w.x, -w.y})
+}
@@ -0,0 +1,193 @@
+/*
+	stores generators of galaxies following physical density profiles, as an alternative to the
+	uniform annulus of InitializeGalaxy
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// Profile is a radial mass distribution stars can be drawn from.
+type Profile interface {
+	// Mass is the total mass of the profile
+	Mass() float64
+	// EnclosedMass is the mass within radius r
+	EnclosedMass(r float64) float64
+	// Radius is the radius enclosing the fraction f of the total mass, for 0 <= f < 1
+	Radius(f float64) float64
+}
+
+// ExponentialDisk has a surface density proportional to exp(-R/scale).
+type ExponentialDisk struct {
+	mass, scale float64
+}
+
+// PlummerSphere has a density proportional to (1 + r^2/scale^2)^(-5/2).
+type PlummerSphere struct {
+	mass, scale float64
+}
+
+// HernquistSphere has a density proportional to 1 / (r (r + scale)^3); it is a good model of bulges and halos.
+type HernquistSphere struct {
+	mass, scale float64
+}
+
+// Component is one population of a model galaxy: numStars stars drawn from profile within cutoff of the center.
+// The stars share the mass the profile has within cutoff.
+type Component struct {
+	profile  Profile
+	numStars int
+	cutoff   float64
+	// rotating components (disks) orbit at the circular velocity; the others (bulges, halos) have random
+	// velocities whose mean square is the square of the circular velocity
+	rotating bool
+	// dispersion is the standard deviation of an extra random velocity along each axis, in m/s
+	dispersion float64
+}
+
+func (d ExponentialDisk) Mass() float64 {
+	return d.mass
+}
+
+func (d ExponentialDisk) EnclosedMass(r float64) float64 {
+	u := r / d.scale
+	return d.mass * (1 - (1+u)*math.Exp(-u))
+}
+
+// Radius has no closed form for an exponential disk: the enclosed mass is inverted by bisection.
+func (d ExponentialDisk) Radius(f float64) float64 {
+	lo, hi := 0.0, 1.0
+	for d.EnclosedMass(hi*d.scale) < f*d.mass {
+		hi *= 2
+	}
+	for i := 0; i < 64; i++ {
+		mid := (lo + hi) / 2
+		if d.EnclosedMass(mid*d.scale) < f*d.mass {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return (lo + hi) / 2 * d.scale
+}
+
+func (p PlummerSphere) Mass() float64 {
+	return p.mass
+}
+
+func (p PlummerSphere) EnclosedMass(r float64) float64 {
+	return p.mass * r * r * r / math.Pow(r*r+p.scale*p.scale, 1.5)
+}
+
+func (p PlummerSphere) Radius(f float64) float64 {
+	if f == 0 {
+		return 0
+	}
+	return p.scale / math.Sqrt(math.Pow(f, -2.0/3.0)-1)
+}
+
+func (h HernquistSphere) Mass() float64 {
+	return h.mass
+}
+
+func (h HernquistSphere) EnclosedMass(r float64) float64 {
+	return h.mass * r * r / ((r + h.scale) * (r + h.scale))
+}
+
+func (h HernquistSphere) Radius(f float64) float64 {
+	s := math.Sqrt(f)
+	return h.scale * s / (1 - s)
+}
+
+// enclosedMass is the mass of the component within r, counting only the stars actually drawn within its cutoff
+func (c Component) enclosedMass(r float64) float64 {
+	return c.profile.EnclosedMass(math.Min(r, c.cutoff))
+}
+
+// InitializeModelGalaxy draws a galaxy made of components around a central black hole of mass blackHoleMass
+// (none if 0), centered on (x, y). Every star moves at the circular velocity sqrt(G M(<r) / r), where M(<r)
+// includes the black hole and all components, as described by Component. As with InitializeGalaxy,
+// the black hole, if any, is the last star of the galaxy, and all randomness comes from rng.
+func InitializeModelGalaxy(rng *rand.Rand, components []Component, blackHoleMass, x, y float64) (Galaxy, error) {
+	for i, c := range components {
+		if c.numStars <= 0 || !(c.cutoff > 0) || !(c.profile.Mass() > 0) {
+			return nil, fmt.Errorf("component %d: number of stars, cutoff and mass must be positive", i)
+		}
+	}
+	enclosedMass := func(r float64) float64 {
+		m := blackHoleMass
+		for _, c := range components {
+			m += c.enclosedMass(r)
+		}
+		return m
+	}
+
+	var g Galaxy
+	for _, c := range components {
+		maxFraction := c.enclosedMass(c.cutoff) / c.profile.Mass()
+		starMass := c.enclosedMass(c.cutoff) / float64(c.numStars)
+
+		for i := 0; i < c.numStars; i++ {
+			var s Star
+			dist := c.profile.Radius(rng.Float64() * maxFraction)
+			angle := rng.Float64() * 2 * math.Pi
+			s.position.x = x + dist*math.Cos(angle)
+			s.position.y = y + dist*math.Sin(angle)
+
+			s.mass = starMass
+			s.radius = 696340000
+			s.red, s.green, s.blue = 255, 255, 255
+
+			var speed float64
+			if dist > 0 {
+				speed = math.Sqrt(G * enclosedMass(dist) / dist)
+			}
+			if c.rotating {
+				s.velocity.x = speed * math.Cos(angle+math.Pi/2.0)
+				s.velocity.y = speed * math.Sin(angle+math.Pi/2.0)
+			} else {
+				s.velocity.x = rng.NormFloat64() * speed / math.Sqrt2
+				s.velocity.y = rng.NormFloat64() * speed / math.Sqrt2
+			}
+			s.velocity.x += rng.NormFloat64() * c.dispersion
+			s.velocity.y += rng.NormFloat64() * c.dispersion
+
+			g = append(g, &s)
+		}
+	}
+
+	if blackHoleMass > 0 {
+		var blackhole Star
+		blackhole.mass = blackHoleMass
+		blackhole.position.x = x
+		blackhole.position.y = y
+		blackhole.blue = 255
+		blackhole.radius = 6963400000
+		g = append(g, &blackhole)
+	}
+	return g, nil
+}
+
+// DiskBulgeHalo returns the components of a typical spiral galaxy: a rotating exponential disk of scale length
+// diskScale and a Hernquist bulge and halo, each holding the given mass and number of stars. Stars of the disk
+// are drawn within 10 scale lengths, those of the bulge and halo within 20 scale radii.
+func DiskBulgeHalo(diskStars, bulgeStars, haloStars int, diskMass, bulgeMass, haloMass, diskScale, bulgeScale, haloScale float64) []Component {
+	components := []Component{
+		{profile: ExponentialDisk{diskMass, diskScale}, numStars: diskStars, cutoff: 10 * diskScale, rotating: true},
+		{profile: HernquistSphere{bulgeMass, bulgeScale}, numStars: bulgeStars, cutoff: 20 * bulgeScale},
+		{profile: HernquistSphere{haloMass, haloScale}, numStars: haloStars, cutoff: 20 * haloScale},
+	}
+
+	// leave out the populations without stars
+	kept := components[:0]
+	for _, c := range components {
+		if c.numStars > 0 {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
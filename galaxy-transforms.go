@@ -0,0 +1,115 @@
+/*
+	stores rigid transformations of galaxies, to reposition and reorient a generated Galaxy. All of them change
+	the stars in place.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// CenterOfMass returns the position and velocity of the center of mass of g.
+func (g Galaxy) CenterOfMass() (OrderedPair, OrderedPair) {
+	var pos, vel OrderedPair
+	var mass float64
+	for _, s := range g {
+		pos.x += s.mass * s.position.x
+		pos.y += s.mass * s.position.y
+		vel.x += s.mass * s.velocity.x
+		vel.y += s.mass * s.velocity.y
+		mass += s.mass
+	}
+	if mass == 0 {
+		return OrderedPair{}, OrderedPair{}
+	}
+	return OrderedPair{pos.x / mass, pos.y / mass}, OrderedPair{vel.x / mass, vel.y / mass}
+}
+
+// Mass returns the total mass of the stars of g.
+func (g Galaxy) Mass() float64 {
+	var mass float64
+	for _, s := range g {
+		mass += s.mass
+	}
+	return mass
+}
+
+// Translate moves every star of g by d; velocities are unchanged (see push to change them).
+func (g Galaxy) Translate(d OrderedPair) {
+	for _, s := range g {
+		s.position.x += d.x
+		s.position.y += d.y
+	}
+}
+
+// MoveTo translates and pushes g so that its center of mass is at pos and moves with velocity vel.
+func (g Galaxy) MoveTo(pos, vel OrderedPair) {
+	c, w := g.CenterOfMass()
+	g.Translate(OrderedPair{pos.x - c.x, pos.y - c.y})
+	push(&g, OrderedPair{vel.x - w.x, vel.y - w.y})
+}
+
+// Rotate turns g counterclockwise by angle (in radians) about its center of mass: positions and velocities
+// relative to the center of mass are rotated, while the center of mass keeps its position and velocity.
+func (g Galaxy) Rotate(angle float64) {
+	c, w := g.CenterOfMass()
+	cos, sin := math.Cos(angle), math.Sin(angle)
+	for _, s := range g {
+		x, y := s.position.x-c.x, s.position.y-c.y
+		s.position.x = c.x + cos*x - sin*y
+		s.position.y = c.y + sin*x + cos*y
+
+		vx, vy := s.velocity.x-w.x, s.velocity.y-w.y
+		s.velocity.x = w.x + cos*vx - sin*vy
+		s.velocity.y = w.y + sin*vx + cos*vy
+	}
+}
+
+// FlipSpin reverses the direction g turns in, by mirroring it across the horizontal line through its
+// center of mass. The center of mass keeps its position and velocity.
+func (g Galaxy) FlipSpin() {
+	g.scaleY(-1)
+}
+
+// Incline shows g tilted out of the plane by inclination (in radians) about the horizontal line through its
+// center of mass, as seen in projection: vertical offsets and velocities relative to the center of mass shrink
+// by the cosine of the inclination, and beyond a right angle the galaxy turns the other way. A projected disk
+// is not in equilibrium in two dimensions, so inclined galaxies slowly change shape.
+func (g Galaxy) Incline(inclination float64) {
+	g.scaleY(math.Cos(inclination))
+}
+
+// scaleY multiplies the vertical offsets and velocities relative to the center of mass by k
+func (g Galaxy) scaleY(k float64) {
+	c, w := g.CenterOfMass()
+	for _, s := range g {
+		s.position.y = c.y + k*(s.position.y-c.y)
+		s.velocity.y = w.y + k*(s.velocity.y-w.y)
+	}
+}
+
+// Rescale multiplies the masses of the stars of g by massFactor and their distances to the center of mass by
+// sizeFactor. Velocities relative to the center of mass are multiplied by sqrt(massFactor / sizeFactor), so that
+// orbits keep their shape and a galaxy in equilibrium stays in equilibrium. Star radii are unchanged.
+// Both factors must be positive and finite; otherwise g is left untouched and an error is returned.
+func (g Galaxy) Rescale(massFactor, sizeFactor float64) error {
+	if !(massFactor > 0) || math.IsInf(massFactor, 1) {
+		return fmt.Errorf("mass factor must be positive and finite, got %g", massFactor)
+	}
+	if !(sizeFactor > 0) || math.IsInf(sizeFactor, 1) {
+		return fmt.Errorf("size factor must be positive and finite, got %g", sizeFactor)
+	}
+
+	c, w := g.CenterOfMass()
+	k := math.Sqrt(massFactor / sizeFactor)
+	for _, s := range g {
+		s.mass *= massFactor
+		s.position.x = c.x + sizeFactor*(s.position.x-c.x)
+		s.position.y = c.y + sizeFactor*(s.position.y-c.y)
+		s.velocity.x = w.x + k*(s.velocity.x-w.x)
+		s.velocity.y = w.y + k*(s.velocity.y-w.y)
+	}
+	return nil
+}
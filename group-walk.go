@@ -0,0 +1,198 @@
+/*
+	stores the group walk of the quad tree: neighbouring stars are gathered in small groups that walk the tree
+	once, against the bounding box of the group, and share the interaction list that walk produces
+*/
+
+package main
+
+import (
+	"math"
+	"sync"
+)
+
+// Group is a set of stars close together in the quad tree, with the interaction list they share: the clusters
+// accepted for the whole group, and the stars summed directly, which include the stars of the group itself.
+type Group struct {
+	stars    []*Star
+	min, max OrderedPair // bounding box of the stars
+
+	cells  []Star       // clusters accepted for every star of the group, as their total mass at their center of mass
+	quads  []Quadrupole // quadrupole moment of every cluster, indexed like cells
+	direct []*Star      // stars that act on the group one by one
+}
+
+// FindGroups cuts the tree below root into groups: the largest subtrees holding at most size stars, and the
+// leaves holding more than that. AssignClusterPos must have been called on root.
+func FindGroups(root *Node, size int) []*Group {
+	var groups []*Group
+	if pending := root.findGroups(size, &groups); pending != nil {
+		groups = append(groups, NewGroup(pending))
+	}
+	return groups
+}
+
+// findGroups returns the stars below n if they may still join those of its siblings in a group, and nil once they are in groups
+func (n *Node) findGroups(size int, groups *[]*Group) []*Star {
+	if n.bucket != nil {
+		return n.bucket
+	}
+	if n.children == nil {
+		return []*Star{n.star}
+	}
+
+	var pending [4][]*Star
+	total, whole := 0, true
+	for q, c := range n.children {
+		if c == nil {
+			continue
+		}
+		pending[q] = c.findGroups(size, groups)
+		if pending[q] == nil {
+			whole = false
+		}
+		total += len(pending[q])
+	}
+	if whole && total <= size {
+		var stars []*Star
+		for _, p := range pending {
+			stars = append(stars, p...)
+		}
+		return stars
+	}
+	for _, p := range pending {
+		if p != nil {
+			*groups = append(*groups, NewGroup(p))
+		}
+	}
+	return nil
+}
+
+// NewGroup returns a group of the given stars, with an empty interaction list.
+func NewGroup(stars []*Star) *Group {
+	g := &Group{stars: stars, min: stars[0].position, max: stars[0].position}
+	for _, s := range stars[1:] {
+		g.min = OrderedPair{math.Min(g.min.x, s.position.x), math.Min(g.min.y, s.position.y)}
+		g.max = OrderedPair{math.Max(g.max.x, s.position.x), math.Max(g.max.y, s.position.y)}
+	}
+	return g
+}
+
+// distance returns the distance from p to the bounding box of g, 0 inside it
+func (g *Group) distance(p OrderedPair) float64 {
+	dx := math.Max(0, math.Max(g.min.x-p.x, p.x-g.max.x))
+	dy := math.Max(0, math.Max(g.min.y-p.y, p.y-g.max.y))
+	return math.Hypot(dx, dy)
+}
+
+// BuildInteractionList walks the tree below root once for the whole group, with the opening rule of
+// ComputeNetForce applied at the point of the bounding box closest to every cluster. A cluster accepted
+// for the group is thus accepted for every star in it, and the group is at least as accurate as the walk
+// of each of its stars.
+func (g *Group) BuildInteractionList(root *Node, settings *Settings) {
+	g.cells, g.quads, g.direct = g.cells[:0], g.quads[:0], g.direct[:0]
+
+	stack := []*Node{root}
+	for len(stack) > 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if current.bucket != nil {
+			g.direct = append(g.direct, current.bucket...)
+			continue
+		}
+		if current.children == nil {
+			g.direct = append(g.direct, current.star)
+			continue
+		}
+
+		d := g.distance(current.star.position)
+		if current.sector.width/d > settings.theta || (settings.multipole >= QuadrupoleOrder && d <= current.ExpansionRadius()) {
+			for _, c := range current.children {
+				if c != nil {
+					stack = append(stack, c)
+				}
+			}
+			continue
+		}
+		g.cells = append(g.cells, Star{position: current.star.position, mass: current.star.mass})
+		g.quads = append(g.quads, current.quadrupole)
+	}
+}
+
+// Accelerations evaluates the interaction list of g for every star of the group, and returns their accelerations, indexed like g.stars.
+func (g *Group) Accelerations(settings *Settings) []OrderedPair {
+	acc := make([]OrderedPair, len(g.stars))
+	for i, star := range g.stars {
+		var F OrderedPair
+		for k := range g.cells {
+			F.Add(ComputeGravityForce(star, &g.cells[k], settings.softening))
+		}
+		if settings.multipole >= QuadrupoleOrder {
+			for k, q := range g.quads {
+				a := q.Acceleration(OrderedPair{star.position.x - g.cells[k].position.x, star.position.y - g.cells[k].position.y})
+				F.Add(OrderedPair{star.mass * a.x, star.mass * a.y})
+			}
+		}
+		for _, other := range g.direct {
+			if other != star {
+				F.Add(ComputeGravityForce(star, other, settings.softening))
+			}
+		}
+		acc[i] = OrderedPair{F.x / star.mass, F.y / star.mass}
+	}
+	return acc
+}
+
+// GroupAccelerations returns the accelerations of the given stars, which must be in the tree qt, indexed like
+// stars. The tree is cut into groups of at most settings.groupSize stars, and only the groups holding one of
+// the stars are walked, by settings.workers goroutines.
+func GroupAccelerations(qt *QuadTree, stars []*Star, settings *Settings) []OrderedPair {
+	index := make(map[*Star]int, len(stars))
+	for i, s := range stars {
+		index[s] = i
+	}
+	var groups []*Group
+	for _, g := range FindGroups(qt.root, settings.groupSize) {
+		for _, s := range g.stars {
+			if _, ok := index[s]; ok {
+				groups = append(groups, g)
+				break
+			}
+		}
+	}
+
+	acc := make([]OrderedPair, len(stars))
+	walk := func(g *Group) {
+		g.BuildInteractionList(qt.root, settings)
+		for k, a := range g.Accelerations(settings) {
+			if i, ok := index[g.stars[k]]; ok {
+				acc[i] = a
+			}
+		}
+	}
+	if settings.workers <= 1 {
+		for _, g := range groups {
+			walk(g)
+		}
+		return acc
+	}
+
+	// every group writes the accelerations of its own stars only
+	var wg sync.WaitGroup
+	chunk := (len(groups) + settings.workers - 1) / settings.workers
+	for start := 0; start < len(groups); start += chunk {
+		end := start + chunk
+		if end > len(groups) {
+			end = len(groups)
+		}
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			for _, g := range groups[start:end] {
+				walk(g)
+			}
+		}(start, end)
+	}
+	wg.Wait()
+	return acc
+}
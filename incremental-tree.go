@@ -0,0 +1,178 @@
+/*
+	stores the incremental quad tree: instead of building a new tree for every force evaluation, the tree of the
+	previous one is kept, the few stars that left their leaf are moved, and the clusters are refitted
+*/
+
+package main
+
+// IncrementalTree keeps a quad tree from one force evaluation to the next. Universes evolved by UpdateUniverse
+// are copies whose stars are new values in the same order, so the tree remembers the leaf of every index of u.stars.
+type IncrementalTree struct {
+	qt     *QuadTree
+	leaves []*Node // leaf holding every star, indexed like u.stars
+
+	updates int // updates since the last full build
+	moved   int // stars that changed leaf since the last rebuild
+
+	rebuilds int // number of full builds, for statistics
+}
+
+// Update returns the quad tree of u, with the mass, center of mass and quadrupole moment of every cluster set.
+// The previous tree is reused unless settings.rebuildEvery updates went by since the last full build, the
+// number of stars changed, a star left the square of the root, or, when settings.rebuildFraction is positive,
+// more than that fraction of the stars changed leaf since the last build: the tree is then built from scratch.
+// Whatever the order of u.stars, the tree returned holds every star of u in the quadrant it belongs to.
+func (t *IncrementalTree) Update(u *Universe, settings *Settings) (*QuadTree, error) {
+	if t.qt == nil || len(t.leaves) != len(u.stars) || t.updates+1 >= settings.rebuildEvery ||
+		(settings.rebuildFraction > 0 && float64(t.moved) > settings.rebuildFraction*float64(len(u.stars))) {
+		return t.rebuild(u, settings)
+	}
+	t.updates++
+
+	// the leaves still point at the stars of the previous universe
+	for _, leaf := range t.leaves {
+		if leaf.bucket != nil {
+			leaf.bucket = leaf.bucket[:0]
+		}
+	}
+	for i, leaf := range t.leaves {
+		if leaf.bucket != nil {
+			leaf.bucket = append(leaf.bucket, u.stars[i])
+		} else {
+			leaf.star = u.stars[i]
+		}
+	}
+
+	for i, s := range u.stars {
+		leaf := t.leaves[i]
+		if leaf.sector.contains(s.position) {
+			continue
+		}
+		if !t.qt.root.sector.contains(s.position) {
+			return t.rebuild(u, settings)
+		}
+
+		// climb to the smallest cluster still holding the star, and insert it again from there
+		ancestor := leaf.remove(s)
+		for !ancestor.sector.contains(s.position) {
+			ancestor = ancestor.parent
+		}
+		sub := *settings
+		sub.maxDepth = settings.maxDepth - ancestor.depth()
+		if err := ancestor.Insert(s, &sub); err != nil {
+			t.qt = nil // the tree is missing a star: start over next time
+			return nil, err
+		}
+		t.leaves[i] = ancestor.leafOf(s)
+		t.moved++
+	}
+
+	AssignClusterPos(t.qt.root)
+	return t.qt, nil
+}
+
+// Reset drops the tree kept by t, so that the next Update builds it from scratch. A checkpoint holds the stars but
+// not the tree, so both the run writing it and the run resuming from it start the tree over from there.
+func (t *IncrementalTree) Reset() {
+	t.qt, t.leaves = nil, nil
+	t.updates, t.moved = 0, 0
+}
+
+// rootMargin is the fraction of the width of the bounding square added on every side of the root of a rebuilt
+// tree, so that the stars on the edge of the universe do not leave it, and force a rebuild, at the next update
+const rootMargin = 0.125
+
+// rebuild builds the tree of u from scratch
+func (t *IncrementalTree) rebuild(u *Universe, settings *Settings) (*QuadTree, error) {
+	q := BoundingQuadrant(u)
+	margin := rootMargin * q.width
+	q = Quadrant{x: q.x - margin, y: q.y - margin, width: q.width + 2*margin}
+	qt, err := BuildQuadTreeIn(u, q, settings)
+	if err != nil {
+		t.qt = nil
+		return nil, err
+	}
+	AssignClusterPos(qt.root)
+
+	index := make(map[*Star]int, len(u.stars))
+	for i, s := range u.stars {
+		index[s] = i
+	}
+	t.leaves = make([]*Node, len(u.stars))
+	qt.root.collectLeaves(index, t.leaves)
+
+	t.qt = qt
+	t.updates, t.moved = 0, 0
+	t.rebuilds++
+	return qt, nil
+}
+
+// collectLeaves records in leaves the leaf holding every star below n, at the index of the star given by index
+func (n *Node) collectLeaves(index map[*Star]int, leaves []*Node) {
+	if n.bucket != nil {
+		for _, s := range n.bucket {
+			leaves[index[s]] = n
+		}
+		return
+	}
+	if n.children == nil {
+		leaves[index[n.star]] = n
+		return
+	}
+	for _, c := range n.children {
+		if c != nil {
+			c.collectLeaves(index, leaves)
+		}
+	}
+}
+
+// remove takes star out of the leaf n, dropping the clusters left empty, and returns the lowest remaining node above it
+func (n *Node) remove(star *Star) *Node {
+	if n.bucket != nil && len(n.bucket) > 1 {
+		for i, s := range n.bucket {
+			if s == star {
+				n.bucket = append(n.bucket[:i], n.bucket[i+1:]...)
+				break
+			}
+		}
+		return n
+	}
+
+	child, parent := n, n.parent
+	for {
+		for q, c := range parent.children {
+			if c == child {
+				parent.children[q] = nil
+			}
+		}
+		if parent.parent == nil || len(parent.GetRealChildren()) > 0 {
+			return parent
+		}
+		child, parent = parent, parent.parent
+	}
+}
+
+// leafOf returns the leaf holding star below n, following the quadrants star falls in
+func (n *Node) leafOf(star *Star) *Node {
+	for n.children != nil {
+		n = n.children[star.whichSubQuad(n.sector)]
+	}
+	return n
+}
+
+// depth is the number of nodes above n
+func (n *Node) depth() int {
+	d := 0
+	for p := n.parent; p != nil; p = p.parent {
+		d++
+	}
+	return d
+}
+
+// contains tells whether p lies in q, edges included. Sectors are halved down from the root with rounding,
+// and a star on the edge of the root may be a few ulps out of the leaf it was inserted into: the edges are
+// widened by a tiny fraction of the width, far too little to change the forces.
+func (q Quadrant) contains(p OrderedPair) bool {
+	slack := 1e-9 * q.width
+	return p.x >= q.x-slack && p.x <= q.x+q.width+slack && p.y >= q.y-slack && p.y <= q.y+q.width+slack
+}
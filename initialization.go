@@ -25,22 +25,23 @@ func InitializeUniverse(galaxies []Galaxy, w float64) *Universe {
 	return &u
 }
 
-// InitializeGalaxy takes number of stars in the galaxy, radius of the galaxy to be constructed,
+// InitializeGalaxy takes a random generator, number of stars in the galaxy, radius of the galaxy to be constructed,
 // and center of galaxy to be constructed. Returns a spinning Galaxy object -- which is just a slice of Star pointers
-func InitializeGalaxy(numOfStars int, r, x, y float64) Galaxy {
+// All randomness comes from rng, so a generator seeded with the same seed always gives the same galaxy.
+func InitializeGalaxy(rng *rand.Rand, numOfStars int, r, x, y float64) Galaxy {
 	g := make(Galaxy, numOfStars)
 
 	for i := range g {
 		var s Star
 
 		// First choose distance to center of galaxy
-		dist := (rand.Float64() + 1.0) / 2.0
+		dist := (rng.Float64() + 1.0) / 2.0
 
 		// multiply by factor of r
 		dist *= r
 
 		// Next choose the angle in radians to represent the rotation
-		angle := rand.Float64() * 2 * math.Pi
+		angle := rng.Float64() * 2 * math.Pi
 
 		// convert polar coordinates to Cartesian
 		s.position.x = x + dist*math.Cos(angle)
@@ -84,6 +85,11 @@ func InitializeGalaxy(numOfStars int, r, x, y float64) Galaxy {
 	return g
 }
 
+// NewRand returns a random generator seeded with seed, to be passed to InitializeGalaxy and the other generators.
+func NewRand(seed int64) *rand.Rand {
+	return rand.New(rand.NewSource(seed))
+}
+
 // push the galaxy toward a direction defined by v
 func push(g *Galaxy, v OrderedPair) {
 	for _, s := range *g {
@@ -0,0 +1,134 @@
+/*
+	stores the time integration schemes used to advance a universe by one time step
+*/
+
+package main
+
+// Integrator advances every star of a universe by one time step.
+// Start is called once on the initial universe, so that schemes relying on the acceleration
+// at the current positions can compute it before the first step.
+// Step moves the stars of u in place; u is always a fresh copy made by UpdateUniverse.
+type Integrator interface {
+	Start(u *Universe, settings *Settings) error
+	Step(u *Universe, dt float64, settings *Settings) error
+}
+
+// Euler is the original scheme: the new acceleration is evaluated at the current positions, but
+// velocities and positions are advanced with the acceleration stored during the previous step.
+// It is first order and drifts over long runs.
+type Euler struct{}
+
+// Leapfrog is the kick-drift-kick leapfrog: half a kick, a full drift, then half a kick with the new acceleration.
+type Leapfrog struct{}
+
+// VelocityVerlet updates positions with the current acceleration, then velocities with the average of the old and new one.
+type VelocityVerlet struct{}
+
+// RK4 is the classic fourth order Runge-Kutta scheme; it costs four force evaluations per step.
+type RK4 struct{}
+
+func (Euler) Start(u *Universe, settings *Settings) error {
+	return nil
+}
+
+func (Euler) Step(u *Universe, dt float64, settings *Settings) error {
+	acc, err := ComputeAccelerations(u, settings)
+	if err != nil {
+		return err
+	}
+	for i, s := range u.stars {
+		s.velocity, s.position = s.NewVelocity(dt), s.NewPosition(dt)
+		s.acceleration = acc[i]
+	}
+	return nil
+}
+
+func (Leapfrog) Start(u *Universe, settings *Settings) error {
+	return SetAccelerations(u, settings)
+}
+
+func (Leapfrog) Step(u *Universe, dt float64, settings *Settings) error {
+	for _, s := range u.stars {
+		s.Kick(dt / 2)
+		s.Drift(dt)
+	}
+	acc, err := ComputeAccelerations(u, settings)
+	if err != nil {
+		return err
+	}
+	for i, s := range u.stars {
+		s.acceleration = acc[i]
+		s.Kick(dt / 2)
+	}
+	return nil
+}
+
+func (VelocityVerlet) Start(u *Universe, settings *Settings) error {
+	return SetAccelerations(u, settings)
+}
+
+func (VelocityVerlet) Step(u *Universe, dt float64, settings *Settings) error {
+	for _, s := range u.stars {
+		s.position = s.NewPosition(dt)
+	}
+	acc, err := ComputeAccelerations(u, settings)
+	if err != nil {
+		return err
+	}
+	for i, s := range u.stars {
+		s.velocity.x += 0.5 * (s.acceleration.x + acc[i].x) * dt
+		s.velocity.y += 0.5 * (s.acceleration.y + acc[i].y) * dt
+		s.acceleration = acc[i]
+	}
+	return nil
+}
+
+func (RK4) Start(u *Universe, settings *Settings) error {
+	return SetAccelerations(u, settings)
+}
+
+// Step uses the stored acceleration as the first stage, and stores the acceleration at the
+// new positions so that it serves as the first stage of the next step.
+func (RK4) Step(u *Universe, dt float64, settings *Settings) error {
+	n := len(u.stars)
+	trial := CopyUniverse(u)
+
+	// k holds the derivatives of position (a velocity) and velocity (an acceleration) of each stage
+	kx := make([][]OrderedPair, 4)
+	kv := make([][]OrderedPair, 4)
+	kx[0] = make([]OrderedPair, n)
+	kv[0] = make([]OrderedPair, n)
+	for i, s := range u.stars {
+		kx[0][i] = s.velocity
+		kv[0][i] = s.acceleration
+	}
+
+	weights := []float64{0.5, 0.5, 1}
+	for k := 1; k < 4; k++ {
+		h := weights[k-1] * dt
+		kx[k] = make([]OrderedPair, n)
+		for i, s := range u.stars {
+			trial.stars[i].position = OrderedPair{
+				x: s.position.x + h*kx[k-1][i].x,
+				y: s.position.y + h*kx[k-1][i].y,
+			}
+			kx[k][i] = OrderedPair{
+				x: s.velocity.x + h*kv[k-1][i].x,
+				y: s.velocity.y + h*kv[k-1][i].y,
+			}
+		}
+		acc, err := ComputeAccelerations(trial, settings)
+		if err != nil {
+			return err
+		}
+		kv[k] = acc
+	}
+
+	for i, s := range u.stars {
+		s.position.x += dt / 6 * (kx[0][i].x + 2*kx[1][i].x + 2*kx[2][i].x + kx[3][i].x)
+		s.position.y += dt / 6 * (kx[0][i].y + 2*kx[1][i].y + 2*kx[2][i].y + kx[3][i].y)
+		s.velocity.x += dt / 6 * (kv[0][i].x + 2*kv[1][i].x + 2*kv[2][i].x + kv[3][i].x)
+		s.velocity.y += dt / 6 * (kv[0][i].y + 2*kv[1][i].y + 2*kv[2][i].y + kv[3][i].y)
+	}
+	return SetAccelerations(u, settings)
+}
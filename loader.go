@@ -0,0 +1,256 @@
+/*
+	stores the loaders building a universe from initial conditions described in a CSV or JSON file
+*/
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Body is one star as described in an initial conditions file.
+type Body struct {
+	Name     string     `json:"name"`
+	Mass     float64    `json:"mass"`
+	Radius   float64    `json:"radius"`
+	Position [2]float64 `json:"position"`
+	Velocity [2]float64 `json:"velocity"`
+	Color    *[3]int    `json:"color"` // white when missing
+}
+
+// System is the content of a JSON initial conditions file:
+//
+//	{"width": 4e9, "bodies": [{"name": "io", "mass": 8.9319e22, "radius": 1821000,
+//	  "position": [1578400000, 2000000000], "velocity": [0, -17320], "color": [249, 249, 165]}, ...]}
+type System struct {
+	Width  float64 `json:"width"`
+	Bodies []Body  `json:"bodies"`
+}
+
+// csvColumns are the columns of a CSV initial conditions file; name and the colors are optional.
+var csvColumns = []string{"name", "mass", "radius", "x", "y", "vx", "vy", "red", "green", "blue"}
+
+// LoadUniverse builds a universe from the file at path, which is read as CSV or JSON depending on its extension.
+func LoadUniverse(path string) (*Universe, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return ReadUniverseCSV(f, path)
+	case ".json":
+		return ReadUniverseJSON(f, path)
+	}
+	return nil, fmt.Errorf("%s: unknown format, expected a .csv or .json file", path)
+}
+
+// ReadUniverseCSV reads initial conditions in CSV form. The first record is "width,<width of the universe>",
+// the second names the columns (see csvColumns, in any order), and every following record is a body:
+//
+//	width,4000000000
+//	name,mass,radius,x,y,vx,vy,red,green,blue
+//	io,8.9319e22,1821000,1578400000,2000000000,0,-17320,249,249,165
+//
+// source names the input in error messages, which also give the line of the offending row.
+func ReadUniverseCSV(r io.Reader, source string) (*Universe, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	record, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: reading width: %v", source, err)
+	}
+	if len(record) != 2 || strings.ToLower(record[0]) != "width" {
+		return nil, fmt.Errorf("%s: line 1: expected \"width,<value>\"", source)
+	}
+	var system System
+	if system.Width, err = strconv.ParseFloat(record[1], 64); err != nil {
+		return nil, fmt.Errorf("%s: line 1: invalid width %q", source, record[1])
+	}
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: reading column names: %v", source, err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range csvColumns {
+		_, found := columns[name]
+		if !found && name != "name" && name != "red" && name != "green" && name != "blue" {
+			return nil, fmt.Errorf("%s: line 2: missing column %q", source, name)
+		}
+	}
+
+	var lines []int
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", source, err)
+		}
+		line, _ := reader.FieldPos(0)
+		if len(record) != len(header) {
+			return nil, fmt.Errorf("%s: line %d: %d fields, expected %d", source, line, len(record), len(header))
+		}
+
+		body, err := parseCSVBody(record, columns)
+		if err != nil {
+			return nil, fmt.Errorf("%s: line %d: %v", source, line, err)
+		}
+		system.Bodies = append(system.Bodies, body)
+		lines = append(lines, line)
+	}
+
+	u, i, err := system.Universe()
+	if err != nil {
+		if i >= 0 {
+			return nil, fmt.Errorf("%s: line %d: %v", source, lines[i], err)
+		}
+		return nil, fmt.Errorf("%s: %v", source, err)
+	}
+	return u, nil
+}
+
+// parseCSVBody reads the body described by a CSV record whose columns are located by columns.
+func parseCSVBody(record []string, columns map[string]int) (Body, error) {
+	var body Body
+	if i, found := columns["name"]; found {
+		body.Name = record[i]
+	}
+
+	values := map[string]*float64{
+		"mass":   &body.Mass,
+		"radius": &body.Radius,
+		"x":      &body.Position[0],
+		"y":      &body.Position[1],
+		"vx":     &body.Velocity[0],
+		"vy":     &body.Velocity[1],
+	}
+	for _, name := range csvColumns {
+		v, isValue := values[name]
+		if !isValue {
+			continue
+		}
+		f, err := strconv.ParseFloat(strings.TrimSpace(record[columns[name]]), 64)
+		if err != nil {
+			return body, fmt.Errorf("invalid %s %q", name, record[columns[name]])
+		}
+		*v = f
+	}
+
+	var color [3]int
+	for k, name := range []string{"red", "green", "blue"} {
+		i, found := columns[name]
+		if !found {
+			color[k] = 255
+			continue
+		}
+		c, err := strconv.Atoi(strings.TrimSpace(record[i]))
+		if err != nil {
+			return body, fmt.Errorf("invalid %s %q", name, record[i])
+		}
+		color[k] = c
+	}
+	body.Color = &color
+	return body, nil
+}
+
+// ReadUniverseJSON reads initial conditions in the JSON form of System.
+// source names the input in error messages, which also give the index of the offending body.
+func ReadUniverseJSON(r io.Reader, source string) (*Universe, error) {
+	var system System
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&system); err != nil {
+		return nil, fmt.Errorf("%s: %v", source, err)
+	}
+
+	u, i, err := system.Universe()
+	if err != nil {
+		if i >= 0 {
+			return nil, fmt.Errorf("%s: bodies[%d]: %v", source, i, err)
+		}
+		return nil, fmt.Errorf("%s: %v", source, err)
+	}
+	return u, nil
+}
+
+// Universe validates the system and builds the corresponding universe.
+// On error, it also returns the index of the offending body, or -1 when the problem is the width.
+func (system *System) Universe() (*Universe, int, error) {
+	if !(system.Width > 0) || math.IsInf(system.Width, 0) {
+		return nil, -1, fmt.Errorf("width must be a positive number, got %g", system.Width)
+	}
+
+	var u Universe
+	u.width = system.Width
+	for i, body := range system.Bodies {
+		s, err := body.Star()
+		if err != nil {
+			return nil, i, err
+		}
+		u.AddStar(s)
+	}
+	if len(u.stars) == 0 {
+		return nil, -1, fmt.Errorf("no bodies")
+	}
+	return &u, -1, nil
+}
+
+// Star validates the body and converts it to a star. Errors start with the name of the body, if any.
+func (body *Body) Star() (Star, error) {
+	s, err := body.star()
+	if err != nil && body.Name != "" {
+		err = fmt.Errorf("%s: %v", body.Name, err)
+	}
+	return s, err
+}
+
+func (body *Body) star() (Star, error) {
+	values := []float64{body.Mass, body.Radius, body.Position[0], body.Position[1], body.Velocity[0], body.Velocity[1]}
+	for _, v := range values {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return Star{}, fmt.Errorf("values must be finite")
+		}
+	}
+	if body.Mass <= 0 {
+		return Star{}, fmt.Errorf("mass must be positive, got %g", body.Mass)
+	}
+	if body.Radius < 0 {
+		return Star{}, fmt.Errorf("radius must not be negative, got %g", body.Radius)
+	}
+
+	color := [3]int{255, 255, 255}
+	if body.Color != nil {
+		color = *body.Color
+	}
+	for _, c := range color {
+		if c < 0 || c > 255 {
+			return Star{}, fmt.Errorf("color components must be between 0 and 255, got %v", color)
+		}
+	}
+
+	var s Star
+	s.mass = body.Mass
+	s.radius = body.Radius
+	s.position = OrderedPair{body.Position[0], body.Position[1]}
+	s.velocity = OrderedPair{body.Velocity[0], body.Velocity[1]}
+	s.red, s.green, s.blue = uint8(color[0]), uint8(color[1]), uint8(color[2])
+	return s, nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"gifhelper"
+	"image"
 	"math"
 	"os"
 )
@@ -55,7 +56,7 @@ func CreateJupiterSystem() *Universe {
 	return &jupiterSystem
 }
 
-func JupiterSimulation() {
+func JupiterSimulation() error {
 	jupiter := CreateJupiterSystem()
 
 	var numGen int = 100000
@@ -65,23 +66,25 @@ func JupiterSimulation() {
 	var animOutputFile string = "animated-jupiter"
 	var frameRate int = 1000
 
-	evolution := BarnesHut(jupiter, numGen, time, 0.5)
+	// draw the animation as we go instead of keeping all 100000 generations around
+	var frames []image.Image
+	final, err := EvolveUniverse(jupiter, numGen, frameRate, DefaultSettings(time, 0.5), AnimateStream(&frames, imgWidth, 2))
+	if err != nil {
+		return err
+	}
 
 	fmt.Println("evolution is complete")
 
 	// write out an animation of the universe
-	frames := AnimateSystem(evolution, imgWidth, frameRate, 2)
 	gifhelper.ImagesToGIF(frames, animOutputFile)
 
 	// export the final frame as an png
-	img := evolution[len(evolution)-1].DrawToCanvas(imgWidth, 2)
-	var c Canvas = CreateNewCanvas(imgWidth, imgWidth)
-	c.img = img
-	c.SaveToPNG(outputFilename)
+	return SaveUniverseToPNG(final, outputFilename, imgWidth, 2)
 }
 
-func GalaxySimulation() {
-	g0 := InitializeGalaxy(500, 4e21, 7e22, 2e22)
+func GalaxySimulation() error {
+	// a fixed seed makes every run draw the same galaxy
+	g0 := InitializeGalaxy(NewRand(1), 500, 4e21, 7e22, 2e22)
 	width := 1.0e23
 	galaxies := []Galaxy{g0}
 	initialUniverse := InitializeUniverse(galaxies, width)
@@ -90,34 +93,47 @@ func GalaxySimulation() {
 	time := 2e14
 	theta := 0.5
 
-	timePoints := BarnesHut(initialUniverse, numGens, time, theta)
-
-	fmt.Println("Simulation run. Now drawing images.")
 	canvasWidth := 900
 	frequency := 1000
 	scalingFactor := 1e11 // a scaling factor is needed to inflate size of stars when drawn because galaxies are very sparse
-	imageList := AnimateSystem(timePoints, canvasWidth, frequency, scalingFactor)
 
-	fmt.Println("Images drawn. Now generating GIF.")
+	// frames are drawn while the simulation runs, so only one generation is held in memory
+	var imageList []image.Image
+	_, err := EvolveUniverse(initialUniverse, numGens, frequency, DefaultSettings(time, theta), AnimateStream(&imageList, canvasWidth, scalingFactor))
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Simulation run and images drawn. Now generating GIF.")
 	gifhelper.ImagesToGIF(imageList, "galaxy")
 	fmt.Println("GIF drawn.")
+	return nil
 }
 
-func CollisionSimulation() {
+func CollisionSimulation() error {
 	// the following sample parameters may be helpful for the "collide" command
 	// all units are in SI (meters, kg, etc.)
 	// but feel free to change the positions of the galaxies.
 
-	g0 := InitializeGalaxy(500, 4e21, 4e22, 3e22)
-	g1 := InitializeGalaxy(500, 4e21, 3e22, 3e22)
-
-	// you probably want to apply a "push" function at this point to these galaxies to move
-	// them toward each other to collide.
-	// be careful: if you push them too fast, they'll just fly through each other.
-	// too slow and the black holes at the center collide and hilarity ensues.
-
-	push(&g0, OrderedPair{-100, 200})
-	push(&g1, OrderedPair{200, -100})
+	// a fixed seed makes every run draw the same galaxies
+	rng := NewRand(1)
+	g0 := InitializeGalaxy(rng, 500, 4e21, 4e22, 3e22)
+	g1 := InitializeGalaxy(rng, 500, 4e21, 3e22, 3e22)
+
+	// put the galaxies on a parabolic orbit that brings their centers within a galaxy radius of each other,
+	// about the point halfway between where they were drawn. Pushing them by hand either sends them
+	// through each other or lets the black holes fall together.
+	encounter := Encounter{
+		mass1:        blackHoleMass + 500*solarMass,
+		mass2:        blackHoleMass + 500*solarMass,
+		pericenter:   4e21,
+		eccentricity: 1,
+		separation:   1e22,
+		center:       OrderedPair{3.5e22, 3e22},
+	}
+	if err := SetupEncounter(g0, g1, encounter); err != nil {
+		return err
+	}
 
 	width := 1.0e23
 
@@ -126,33 +142,32 @@ func CollisionSimulation() {
 	initialUniverse := InitializeUniverse(galaxies, width)
 
 	// now evolve the universe: feel free to adjust the following parameters.
-	// There is a maximum number of steps we can simulate the collision. If we reach a point where two black holes have collided with eacher, their position will be the same, and the quadtree will be stuck in an infinite loop trying to allocate them into the right places. The tree will grow indefinitely because no matter how we divide the quadrants, these two black holes will always end up in the same quadrant.
+	// When the two black holes collide their positions become the same and no amount of dividing quadrants separates them. The quad tree stops at settings.maxDepth and keeps such stars together in a bucket (or merges them, see MergeCoincident), so the run can go on as long as we like.
 	numGens := 10000
 	time := 3e15
 	theta := 0.5
 
-	timePoints := BarnesHut(initialUniverse, numGens, time, theta)
+	// soften gravity over roughly half the mean spacing of the stars so close passes do not fling stars away
+	settings := DefaultSettings(time, theta)
+	settings.softening = Softening{kind: PlummerSoftening, epsilon: 1e20}
 
-	fmt.Println("Simulation run. Now drawing images.")
 	canvasWidth := 1000
 	frequency := 1000
 	scalingFactor := 1e11 // a scaling factor is needed to inflate size of stars when drawn because galaxies are very sparse
-	imageList := AnimateSystem(timePoints, canvasWidth, frequency, scalingFactor)
 
-	fmt.Println("Images drawn. Now generating GIF.")
+	// frames are drawn while the simulation runs, so only one generation is held in memory
+	var imageList []image.Image
+	_, err := EvolveUniverse(initialUniverse, numGens, frequency, settings, AnimateStream(&imageList, canvasWidth, scalingFactor))
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Simulation run and images drawn. Now generating GIF.")
 	gifhelper.ImagesToGIF(imageList, "collision")
 	fmt.Println("GIF drawn.")
+	return nil
 }
 
 func main() {
-	cmd := os.Args[1]
-	if cmd == "jupiter" {
-		JupiterSimulation()
-	} else if cmd == "galaxy" {
-		GalaxySimulation()
-	} else if cmd == "collision" {
-		CollisionSimulation()
-	} else {
-		panic("hey, please choose command form jupiter/galaxy/collision (case-sensitive).")
-	}
+	os.Exit(RunCommand(os.Args[1:]))
 }
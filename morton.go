@@ -0,0 +1,294 @@
+/*
+	stores the Morton (Z-order) construction of the quad tree: stars are sorted along the Z-order curve of
+	the bounding square, and the tree is built bottom-up from the prefixes the sorted keys share, instead of
+	inserting stars one by one from the root
+*/
+
+package main
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// mortonBits is the number of bits of each coordinate in a Morton key, so the number of tree levels a key can tell apart
+const mortonBits = 32
+
+// mortonQuadrant maps the two bits of a key at some level, (y << 1) | x, to the quadrant numbering of whichSubQuad
+var mortonQuadrant = [4]int{2, 3, 0, 1}
+
+// MortonKey returns the Morton key of p within the square q: the bits of its quantized coordinates
+// interleaved, the highest pair selecting the quadrant of q holding p, the next pair the quadrant of
+// that quadrant, and so on. Sorting by key orders points along the Z-order curve.
+// Points on a dividing line go where whichSubQuad sends them: east of a vertical line, south of a horizontal one.
+func MortonKey(p OrderedPair, q Quadrant) uint64 {
+	x := mortonQuantize(p.x, q.x, q.width, false)
+	y := mortonQuantize(p.y, q.y, q.width, true)
+	return spreadBits(x) | spreadBits(y)<<1
+}
+
+// mortonQuantize maps v in [lo, lo+width] to an integer of mortonBits bits. A value on the boundary between
+// two integers goes to the upper one, or to the lower one when down is set.
+func mortonQuantize(v, lo, width float64, down bool) uint32 {
+	f := (v - lo) / width * (1 << mortonBits)
+	if !(f > 0) {
+		return 0
+	}
+	if f >= 1<<mortonBits {
+		return 1<<mortonBits - 1
+	}
+	if down {
+		return uint32(math.Ceil(f)) - 1
+	}
+	return uint32(math.Floor(f))
+}
+
+// spreadBits moves bit i of v to bit 2i
+func spreadBits(v uint32) uint64 {
+	x := uint64(v)
+	x = (x | x<<16) & 0x0000ffff0000ffff
+	x = (x | x<<8) & 0x00ff00ff00ff00ff
+	x = (x | x<<4) & 0x0f0f0f0f0f0f0f0f
+	x = (x | x<<2) & 0x3333333333333333
+	x = (x | x<<1) & 0x5555555555555555
+	return x
+}
+
+// mortonStar is a star with its Morton key and its index in u.stars
+type mortonStar struct {
+	key   uint64
+	star  *Star
+	index int
+}
+
+// sortByMorton returns the stars of u with their keys in the bounding square q, sorted by key.
+// Stars with the same key keep their order in u.stars.
+func sortByMorton(u *Universe, q Quadrant) []mortonStar {
+	entries := make([]mortonStar, len(u.stars))
+	for i, s := range u.stars {
+		entries[i] = mortonStar{key: MortonKey(s.position, q), star: s, index: i}
+	}
+	if !insertionSortByKey(entries, 8*len(entries)) {
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].key < entries[j].key
+		})
+	}
+	return entries
+}
+
+// insertionSortByKey sorts entries by key, stably, unless that takes more than budget moves, and tells whether it
+// did. Under the Morton order u.stars was sorted one step earlier, so the keys are nearly in order, and a few
+// moves sort them in linear time; sorted keys cost no move at all.
+func insertionSortByKey(entries []mortonStar, budget int) bool {
+	for i := 1; i < len(entries); i++ {
+		e := entries[i]
+		j := i
+		for ; j > 0 && entries[j-1].key > e.key; j-- {
+			if budget--; budget < 0 {
+				entries[j] = e // leave a permutation of the entries behind
+				return false
+			}
+			entries[j] = entries[j-1]
+		}
+		entries[j] = e
+	}
+	return true
+}
+
+// SortStarsByMorton reorders u.stars along the Z-order curve of their bounding square, so that stars close in
+// space are close in memory, and the tree walks of neighbouring stars touch the same nodes one after the other.
+func SortStarsByMorton(u *Universe) {
+	for i, e := range sortByMorton(u, BoundingQuadrant(u)) {
+		u.stars[i] = e.star
+	}
+}
+
+// BuildQuadTreeMorton builds the same tree as BuildQuadTree, with the same handling of coincident stars, by
+// sorting the stars by Morton key and building the tree bottom-up from the sorted keys, see buildMorton.
+// u.stars is left untouched; see SortStarsByMorton.
+func BuildQuadTreeMorton(u *Universe, settings *Settings) (*QuadTree, error) {
+	sub := *settings
+	sub.mortonOrder = true
+	return BuildQuadTreeIn(u, BoundingQuadrant(u), &sub)
+}
+
+// mortonLevels returns the number of leading quadrant digits, one for every level of the tree, that the keys a and b share
+func mortonLevels(a, b uint64) int {
+	return bits.LeadingZeros64(a^b) / 2
+}
+
+// mortonDigit returns the quadrant digit of key selecting the child at the given depth, 1 for the children of the root
+func mortonDigit(key uint64, depth int) int {
+	return int(key >> uint(2*(mortonBits-depth)) & 3)
+}
+
+// mortonItem is a node of the tree under construction, at the given depth, with the key of its first star
+type mortonItem struct {
+	node  *Node
+	key   uint64
+	depth int
+}
+
+// mortonLeaf is a leaf made from the sorted keys, with the stars still to be put in it once its sector is known:
+// the rest of a bucket, or, when insert is set, the stars whose keys are equal, to be inserted under it.
+type mortonLeaf struct {
+	node   *Node
+	stars  []mortonStar // every star of the leaf, the first one included
+	insert bool
+}
+
+// buildMorton builds the tree below the root n bottom-up from entries, which lie in its sector and are sorted by key.
+// Every star first gets a leaf at the shallowest depth where no other key shares its prefix; the stars sharing
+// settings.maxDepth levels share a bucket, and those with equal keys, which need more levels than a key holds, a
+// node they are inserted under. The internal nodes are then made level by level, from the deepest up, each from
+// the nodes of the level below whose keys share its prefix. When rounding puts a star in a sector other than the
+// one of its key, the tree is built by insertion instead, so that it is always the tree of BuildQuadTree.
+func (n *Node) buildMorton(entries []mortonStar, settings *Settings) error {
+	limit := settings.maxDepth
+	if limit > mortonBits {
+		limit = mortonBits
+	}
+
+	var leaves []mortonLeaf
+	var items []mortonItem
+	deepest := 0
+	for start := 0; start < len(entries); {
+		end := start + 1
+		for end < len(entries) && mortonLevels(entries[start].key, entries[end].key) >= limit {
+			end++
+		}
+		leaf := mortonLeaf{stars: entries[start:end]}
+		depth := limit
+		switch {
+		case end-start == 1:
+			// one level below the longest prefix shared with a neighbour
+			depth = 0
+			if start > 0 {
+				depth = mortonLevels(entries[start-1].key, entries[start].key)
+			}
+			if end < len(entries) {
+				if shared := mortonLevels(entries[start].key, entries[end].key); shared > depth {
+					depth = shared
+				}
+			}
+			depth++
+			leaf.node = &Node{star: entries[start].star}
+		case limit == settings.maxDepth:
+			// insertion fills a bucket in the order of u.stars, whatever the keys
+			sortByIndex(leaf.stars)
+			leaf.node = &Node{star: leaf.stars[0].star}
+		default:
+			leaf.node = &Node{children: make([]*Node, 4)}
+			leaf.insert = true
+		}
+		leaves = append(leaves, leaf)
+		items = append(items, mortonItem{node: leaf.node, key: entries[start].key, depth: depth})
+		if depth > deepest {
+			deepest = depth
+		}
+		start = end
+	}
+
+	for depth := deepest; depth >= 1; depth-- {
+		items = n.gatherMorton(items, depth)
+	}
+	n.placeMorton()
+
+	for _, leaf := range leaves {
+		for _, e := range leaf.stars {
+			if !e.star.inSectorsAbove(leaf.node) {
+				// within rounding of a dividing line, a key and the sectors disagree: let the sectors decide
+				n.children = make([]*Node, 4)
+				sortByIndex(entries)
+				return n.insertAll(entries, 0, settings)
+			}
+		}
+	}
+	for _, leaf := range leaves {
+		if leaf.insert {
+			if err := leaf.node.insertAll(leaf.stars, mortonBits, settings); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, e := range leaf.stars[1:] {
+			if err := leaf.node.AddToBucket(e.star, settings.coincident); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// sortByIndex puts entries back in the order of u.stars
+func sortByIndex(entries []mortonStar) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].index < entries[j].index
+	})
+}
+
+// gatherMorton makes the parents of the items at the given depth, which are consecutive when their keys share the
+// prefix of the parent, and returns them in place of their children. The parents of depth 1 are the root n.
+func (n *Node) gatherMorton(items []mortonItem, depth int) []mortonItem {
+	shift := uint(2 * (mortonBits - depth + 1))
+	parents := items[:0] // never more than the items read so far
+	for i := 0; i < len(items); {
+		if items[i].depth != depth {
+			parents = append(parents, items[i])
+			i++
+			continue
+		}
+		parent := n
+		if depth > 1 {
+			parent = &Node{children: make([]*Node, 4)}
+		}
+		first := items[i]
+		for ; i < len(items) && items[i].depth == depth && items[i].key>>shift == first.key>>shift; i++ {
+			child := items[i].node
+			parent.children[mortonQuadrant[mortonDigit(items[i].key, depth)]] = child
+			child.parent = parent
+		}
+		if depth > 1 {
+			parents = append(parents, mortonItem{node: parent, key: first.key, depth: depth - 1})
+		}
+	}
+	return parents
+}
+
+// placeMorton sets the sectors of the nodes below n, whose own sector is set, and puts at the center of its sector
+// the star of every internal node, as NewDummy does
+func (n *Node) placeMorton() {
+	for q, c := range n.children {
+		if c == nil {
+			continue
+		}
+		c.sector = n.sector.findNewQuad(q)
+		if c.children != nil {
+			c.star = &Star{position: c.center()}
+			c.placeMorton()
+		}
+	}
+}
+
+// inSectorsAbove tells whether every node above node holds node in the quadrant whichSubQuad gives for s
+func (s *Star) inSectorsAbove(node *Node) bool {
+	for c, p := node, node.parent; p != nil; c, p = p, p.parent {
+		if p.children[s.whichSubQuad(p.sector)] != c {
+			return false
+		}
+	}
+	return true
+}
+
+// insertAll inserts entries one by one under the internal node n at the given depth, counting depth from n
+func (n *Node) insertAll(entries []mortonStar, depth int, settings *Settings) error {
+	sub := *settings
+	sub.maxDepth = settings.maxDepth - depth
+	for _, e := range entries {
+		if err := n.Insert(e.star, &sub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
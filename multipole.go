@@ -0,0 +1,91 @@
+/*
+	stores the multipole expansion of clusters of stars: the quadrupole correction added to the monopole
+	(total mass at the center of mass) when the quad tree walk accepts a cluster
+*/
+
+package main
+
+import "math"
+
+// Quadrupole holds the in-plane components of the traceless quadrupole moment of a cluster about its center of mass,
+//
+//	Q_ij = sum over stars of m (3 d_i d_j - |d|^2 delta_ij)
+//
+// where d is the offset of a star from the center of mass. Gravity is the three dimensional 1/r^2 law restricted to
+// the plane, so xx and yy do not sum to zero: the zz component makes up the trace, and never acts within the plane.
+type Quadrupole struct {
+	xx, xy, yy float64
+}
+
+// AddMass adds to q the moment of mass m at offset d from the center of mass q is taken about.
+func (q *Quadrupole) AddMass(m float64, d OrderedPair) {
+	r2 := d.x*d.x + d.y*d.y
+	q.xx += m * (3*d.x*d.x - r2)
+	q.xy += m * 3 * d.x * d.y
+	q.yy += m * (3*d.y*d.y - r2)
+}
+
+// Add adds to q the moment q2 of a sub-cluster of mass m whose center of mass is at offset d from that of q,
+// by the parallel axis theorem.
+func (q *Quadrupole) Add(q2 Quadrupole, m float64, d OrderedPair) {
+	q.xx += q2.xx
+	q.xy += q2.xy
+	q.yy += q2.yy
+	q.AddMass(m, d)
+}
+
+// Acceleration is the quadrupole term of the acceleration felt at offset r from the center of mass of the cluster:
+//
+//	G (Q r / |r|^5 - 5/2 (r.Q.r) r / |r|^7)
+func (q Quadrupole) Acceleration(r OrderedPair) OrderedPair {
+	r2 := r.x*r.x + r.y*r.y
+	if r2 == 0 {
+		return OrderedPair{}
+	}
+	qr := OrderedPair{q.xx*r.x + q.xy*r.y, q.xy*r.x + q.yy*r.y}
+	rqr := r.x*qr.x + r.y*qr.y
+	r5 := r2 * r2 * math.Sqrt(r2)
+	return OrderedPair{
+		x: G * (qr.x - 2.5*rqr*r.x/r2) / r5,
+		y: G * (qr.y - 2.5*rqr*r.y/r2) / r5,
+	}
+}
+
+// Gradient is the gradient of Acceleration at r, a symmetric matrix:
+//
+//	G (Q_ij/|r|^5 - 5 ((Q r)_i r_j + (Q r)_j r_i)/|r|^7 - 5/2 (r.Q.r) delta_ij/|r|^7 + 35/2 (r.Q.r) r_i r_j/|r|^9)
+func (q Quadrupole) Gradient(r OrderedPair) (xx, xy, yy float64) {
+	r2 := r.x*r.x + r.y*r.y
+	if r2 == 0 {
+		return 0, 0, 0
+	}
+	qr := OrderedPair{q.xx*r.x + q.xy*r.y, q.xy*r.x + q.yy*r.y}
+	rqr := r.x*qr.x + r.y*qr.y
+	r5 := r2 * r2 * math.Sqrt(r2)
+	r7 := r5 * r2
+	r9 := r7 * r2
+	xx = G * (q.xx/r5 - 10*qr.x*r.x/r7 - 2.5*rqr/r7 + 17.5*rqr*r.x*r.x/r9)
+	xy = G * (q.xy/r5 - 5*(qr.x*r.y+qr.y*r.x)/r7 + 17.5*rqr*r.x*r.y/r9)
+	yy = G * (q.yy/r5 - 10*qr.y*r.y/r7 - 2.5*rqr/r7 + 17.5*rqr*r.y*r.y/r9)
+	return xx, xy, yy
+}
+
+// Potential is the quadrupole term of the potential per unit mass at offset r from the center of mass of the cluster:
+//
+//	-G (r.Q.r) / (2 |r|^5)
+func (q Quadrupole) Potential(r OrderedPair) float64 {
+	r2 := r.x*r.x + r.y*r.y
+	if r2 == 0 {
+		return 0
+	}
+	rqr := q.xx*r.x*r.x + 2*q.xy*r.x*r.y + q.yy*r.y*r.y
+	return -G * rqr / (2 * r2 * r2 * math.Sqrt(r2))
+}
+
+// ExpansionRadius is the distance from the center of mass of n to the farthest corner of its sector: the multipole
+// expansion of n only holds farther away than that.
+func (n *Node) ExpansionRadius() float64 {
+	dx := math.Max(n.star.position.x-n.sector.x, n.sector.x+n.sector.width-n.star.position.x)
+	dy := math.Max(n.star.position.y-n.sector.y, n.sector.y+n.sector.width-n.star.position.y)
+	return math.Hypot(dx, dy)
+}
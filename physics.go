@@ -26,27 +26,110 @@ func (s *Star) NewPosition(t float64) OrderedPair {
 	}
 }
 
-// UpdateAccel computes the new accerlation vector for b
-func (s *Star) NewAccel(qt *QuadTree, univ *Universe, theta float64) OrderedPair {
-	F := ComputeNetForce(qt, s, theta)
+// Kick advances the velocity of s by dt using its stored acceleration.
+func (s *Star) Kick(dt float64) {
+	s.velocity.x += s.acceleration.x * dt
+	s.velocity.y += s.acceleration.y * dt
+}
+
+// Drift advances the position of s by dt using its current velocity.
+func (s *Star) Drift(dt float64) {
+	s.position.x += s.velocity.x * dt
+	s.position.y += s.velocity.y * dt
+}
+
+// Merge absorbs s2 into s: masses add up, s moves to the center of mass and takes the velocity
+// that conserves momentum. The merged body keeps the volume of both and the color of the heavier one.
+func (s *Star) Merge(s2 *Star) {
+	m := s.mass + s2.mass
+	s.position = CenterOfMass(s, s2)
+	s.velocity = OrderedPair{
+		x: (s.mass*s.velocity.x + s2.mass*s2.velocity.x) / m,
+		y: (s.mass*s.velocity.y + s2.mass*s2.velocity.y) / m,
+	}
+	s.acceleration = OrderedPair{
+		x: (s.mass*s.acceleration.x + s2.mass*s2.acceleration.x) / m,
+		y: (s.mass*s.acceleration.y + s2.mass*s2.acceleration.y) / m,
+	}
+	s.radius = math.Cbrt(s.radius*s.radius*s.radius + s2.radius*s2.radius*s2.radius)
+	if s2.mass > s.mass {
+		s.red, s.green, s.blue = s2.red, s2.green, s2.blue
+	}
+	s.mass = m
+}
+
+// NewAccel computes the new accerlation vector for s
+func (s *Star) NewAccel(qt *QuadTree, settings *Settings) OrderedPair {
+	F := ComputeNetForce(qt, s, settings)
 	return OrderedPair{
 		x: F.x / s.mass,
 		y: F.y / s.mass,
 	}
 }
 
-// ComputeGravityForce computes the gravity force between star 1 and star 2.
-func ComputeGravityForce(s1, s2 *Star) OrderedPair {
+// ComputeGravityForce computes the gravity force between star 1 and star 2, smoothed according to softening.
+func ComputeGravityForce(s1, s2 *Star, softening Softening) OrderedPair {
 	d := Dist(s1, s2)
+	if d == 0 {
+		// coincident stars: the direction of the force is undefined, and every kernel goes to zero here
+		return OrderedPair{}
+	}
 	deltaX := s2.position.x - s1.position.x
 	deltaY := s2.position.y - s1.position.y
-	F := G * s1.mass * s2.mass / (d * d)
 
-	r := OrderedPair{
-		x: F * deltaX / d,
-		y: F * deltaY / d,
+	if softening.kind == NoSoftening {
+		F := G * s1.mass * s2.mass / (d * d)
+		return OrderedPair{
+			x: F * deltaX / d,
+			y: F * deltaY / d,
+		}
+	}
+
+	F := G * s1.mass * s2.mass * softening.Kernel(d)
+	return OrderedPair{
+		x: F * deltaX,
+		y: F * deltaY,
+	}
+}
+
+// Kernel returns the factor k(d) such that the softened force between two unit masses at distance d is G*k(d)*d.
+// Without softening k(d) = 1/d^3.
+func (sf Softening) Kernel(d float64) float64 {
+	eps := sf.epsilon
+	switch sf.kind {
+	case PlummerSoftening:
+		r2 := d*d + eps*eps
+		return 1 / (r2 * math.Sqrt(r2))
+	case SplineSoftening:
+		// cubic spline of Monaghan & Lattanzio, as used in GADGET: compact support h = 2.8 epsilon
+		h := 2.8 * eps
+		u := d / h
+		if u < 0.5 {
+			return (10.666666666667 + u*u*(32.0*u-38.4)) / (h * h * h)
+		} else if u < 1 {
+			return (21.333333333333 - 48.0*u + 38.4*u*u - 10.666666666667*u*u*u - 0.066666666667/(u*u*u)) / (h * h * h)
+		}
+	}
+	return 1 / (d * d * d)
+}
+
+// Potential returns the factor p(d) such that the softened potential energy of two unit masses at distance d is -G*p(d).
+// It is consistent with Kernel: without softening p(d) = 1/d.
+func (sf Softening) Potential(d float64) float64 {
+	eps := sf.epsilon
+	switch sf.kind {
+	case PlummerSoftening:
+		return 1 / math.Sqrt(d*d+eps*eps)
+	case SplineSoftening:
+		h := 2.8 * eps
+		u := d / h
+		if u < 0.5 {
+			return -(-2.8 + u*u*(5.333333333333+u*u*(6.4*u-9.6))) / h
+		} else if u < 1 {
+			return -(-3.2 + 0.066666666667/u + u*u*(10.666666666667+u*(-16.0+u*(9.6-2.133333333333*u)))) / h
+		}
 	}
-	return r
+	return 1 / d
 }
 
 // Compute the Euclidian Distance between two stars
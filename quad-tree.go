@@ -6,48 +6,138 @@ package main
 
 import (
 	"fmt"
+	"math"
+	"sync"
 )
 
-//BuildQuadTree builds a quad tree for a universe
-func BuildQuadTree(u *Universe) *QuadTree {
-	var qt QuadTree = QuadTree{root: InitRoot(u)}
+//BuildQuadTree builds a quad tree for a universe.
+//Stars that still share a leaf at settings.maxDepth are handled according to settings.coincident;
+//an error is returned only under the ErrorCoincident policy.
+func BuildQuadTree(u *Universe, settings *Settings) (*QuadTree, error) {
+	return BuildQuadTreeIn(u, BoundingQuadrant(u), settings)
+}
+
+//BuildQuadTreeIn is BuildQuadTree with the square q, which must contain every star, as the sector of the root.
+func BuildQuadTreeIn(u *Universe, q Quadrant, settings *Settings) (*QuadTree, error) {
+	var qt QuadTree = QuadTree{root: NewRoot(q)}
+	if settings.mortonOrder {
+		if err := qt.root.buildMorton(sortByMorton(u, q), settings); err != nil {
+			return nil, err
+		}
+		return &qt, nil
+	}
+	if settings.parallelTree {
+		if err := qt.root.InsertParallel(u.stars, settings); err != nil {
+			return nil, err
+		}
+		return &qt, nil
+	}
 
 	// start building the quad tree:
 	for i := 0; i < len((*u).stars); i++ {
-		parent := qt.root
-		star := u.stars[i]
-		q := star.whichSubQuad(parent.sector)
-		next := parent.children[q]
-
-		// find	where to insert the new star into the quad tree
-		for next != nil {
-			// is the occupied child a dummy or actual star?
-			if next.children != nil {
-				// the occupied child is a dummy
-				parent = next
-			} else {
-				// the occupied child is an actual star
-				// we need another dummy star as the new parent
-				var newDummy *Node = parent.NewDummy(q)
-				parent.children[q] = newDummy
-				// put the previous star back under the dummy
-				nq := next.star.whichSubQuad(newDummy.sector)
-				newDummy.children[nq] = next
-				parent = newDummy
+		if err := qt.root.Insert(u.stars[i], settings); err != nil {
+			return nil, err
+		}
+	}
+	return &qt, nil
+}
+
+//InsertParallel inserts stars under the internal node n with one goroutine per quadrant of n.
+//Each goroutine only touches its own child of n, and inserts its stars in their original order,
+//so the tree is exactly the one a serial insertion would build.
+func (n *Node) InsertParallel(stars []*Star, settings *Settings) error {
+	var quadrants [4][]*Star
+	for _, s := range stars {
+		q := s.whichSubQuad(n.sector)
+		quadrants[q] = append(quadrants[q], s)
+	}
+
+	var errs [4]error
+	var wg sync.WaitGroup
+	for q := range quadrants {
+		wg.Add(1)
+		go func(q int) {
+			defer wg.Done()
+			for _, s := range quadrants[q] {
+				if err := n.Insert(s, settings); err != nil {
+					errs[q] = err
+					return
+				}
 			}
-			q = star.whichSubQuad(parent.sector)
-			next = parent.children[q]
+		}(q)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
 		}
+	}
+	return nil
+}
+
+//Insert places star in the subtree rooted at the internal node n, which sits at depth 0.
+func (n *Node) Insert(star *Star, settings *Settings) error {
+	parent := n
+	q := star.whichSubQuad(parent.sector)
+	next := parent.children[q]
+	depth := 1 // depth of next
 
-		//we've found the parent of the star; insert star under that parent:
-		parent.children[q] = &Node{
-			children: nil,
-			star:     star,
-			sector:   parent.sector.findNewQuad(q),
+	// find	where to insert the new star into the quad tree
+	for next != nil {
+		// is the occupied child a dummy or actual star?
+		if next.children != nil {
+			// the occupied child is a dummy
+			parent = next
+		} else if depth >= settings.maxDepth {
+			// the occupied child is an actual star, but we are not allowed to split any further:
+			// without this, two stars at the same position would have us split quadrants forever
+			return next.AddToBucket(star, settings.coincident)
+		} else {
+			// the occupied child is an actual star
+			// we need another dummy star as the new parent
+			var newDummy *Node = parent.NewDummy(q)
+			parent.children[q] = newDummy
+			// put the previous star back under the dummy
+			nq := next.star.whichSubQuad(newDummy.sector)
+			newDummy.children[nq] = next
+			next.parent = newDummy
+			next.sector = newDummy.sector.findNewQuad(nq)
+			parent = newDummy
 		}
+		q = star.whichSubQuad(parent.sector)
+		next = parent.children[q]
+		depth++
+	}
+
+	//we've found the parent of the star; insert star under that parent:
+	parent.children[q] = &Node{
+		parent:   parent,
+		children: nil,
+		star:     star,
+		sector:   parent.sector.findNewQuad(q),
+	}
+	return nil
+}
 
+//AddToBucket adds star to the leaf n, which has reached the maximum depth of the tree.
+//The first time, the star of the leaf moves into the bucket and is replaced with a dummy
+//whose mass and position are set by AssignClusterPos.
+func (n *Node) AddToBucket(star *Star, policy CoincidentPolicy) error {
+	if policy == ErrorCoincident {
+		other := n.star
+		if n.bucket != nil {
+			other = n.bucket[0]
+		}
+		return fmt.Errorf("quad tree: stars at (%g, %g) and (%g, %g) cannot be separated by a quadrant of width %g",
+			star.position.x, star.position.y, other.position.x, other.position.y, n.sector.width)
+	}
+	if n.bucket == nil {
+		n.bucket = []*Star{n.star}
+		n.star = &Star{position: n.star.position}
 	}
-	return &qt
+	n.bucket = append(n.bucket, star)
+	return nil
 }
 
 // prints the content of the quad tree in a BFS manner. For debugging purpose only
@@ -100,7 +190,7 @@ func AssignClusterPos(n *Node) PseudoStar {
 		n.star.mass = 0
 
 		for i := 0; i < len(children); i++ {
-			if children[i].children == nil {
+			if children[i].children == nil && children[i].bucket == nil {
 				n.star.position = CenterOfMass(n.star, children[i].star)
 				n.star.mass += children[i].star.mass
 			} else {
@@ -109,6 +199,26 @@ func AssignClusterPos(n *Node) PseudoStar {
 				n.star.mass += ps.mass
 			}
 		}
+
+		// the quadrupole moment needs the final center of mass, so it is summed once all children are done
+		n.quadrupole = Quadrupole{}
+		for _, c := range children {
+			n.quadrupole.Add(c.quadrupole, c.star.mass, OrderedPair{c.star.position.x - n.star.position.x, c.star.position.y - n.star.position.y})
+		}
+	} else if n.bucket != nil {
+		// a bucket leaf is a cluster of stars that could not be separated
+		n.star.position.x = 0
+		n.star.position.y = 0
+		n.star.mass = 0
+
+		for _, b := range n.bucket {
+			n.star.position = CenterOfMass(n.star, b)
+			n.star.mass += b.mass
+		}
+		n.quadrupole = Quadrupole{}
+		for _, b := range n.bucket {
+			n.quadrupole.AddMass(b.mass, OrderedPair{b.position.x - n.star.position.x, b.position.y - n.star.position.y})
+		}
 	}
 	return PseudoStar{
 		x:    n.star.position.x,
@@ -169,19 +279,20 @@ func (n *Node) GetRealChildren() []*Node {
 // 	return false
 // }
 
-//InitRoot initializes a root node for a quad tree, given the size of the universe:
+//InitRoot initializes a root node for a quad tree covering the bounding square of all stars.
+//Stars are free to leave [0, width], so the root can not simply be the universe: a star outside
+//the root would be sorted into an edge quadrant that does not contain it, and Theta would be wrong.
 func InitRoot(u *Universe) *Node {
 	// define the outermost quadrant:
-	var q Quadrant = Quadrant{
-		x:     0,
-		y:     0,
-		width: u.width,
-	}
+	return NewRoot(BoundingQuadrant(u))
+}
 
+//NewRoot returns an empty root node covering the square q.
+func NewRoot(q Quadrant) *Node {
 	var s Star = Star{
 		position: OrderedPair{
-			x: u.width / 2,
-			y: u.width / 2,
+			x: q.x + q.width/2,
+			y: q.y + q.width/2,
 		},
 	}
 
@@ -193,6 +304,28 @@ func InitRoot(u *Universe) *Node {
 	return &root
 }
 
+//BoundingQuadrant returns the smallest square whose bottom left corner is the lowest x and y over all stars, and that contains every star.
+//When the stars occupy a single point, the square has the width of the universe.
+func BoundingQuadrant(u *Universe) Quadrant {
+	if len(u.stars) == 0 {
+		return Quadrant{x: 0, y: 0, width: u.width}
+	}
+	minX, minY := u.stars[0].position.x, u.stars[0].position.y
+	maxX, maxY := minX, minY
+	for _, s := range u.stars[1:] {
+		minX = math.Min(minX, s.position.x)
+		minY = math.Min(minY, s.position.y)
+		maxX = math.Max(maxX, s.position.x)
+		maxY = math.Max(maxY, s.position.y)
+	}
+
+	width := math.Max(maxX-minX, maxY-minY)
+	if width == 0 {
+		width = u.width
+	}
+	return Quadrant{x: minX, y: minY, width: width}
+}
+
 //whichSubQuad determines which quadrant(NW, NE, SW, SE) the star belongs to
 //returns a number correponding to each sub-quadrant:
 /*
@@ -260,35 +393,15 @@ func (q *Quadrant) findNewQuad(i int) Quadrant {
 	}
 }
 
-// creates a new dummy node from an existing node from one of its quadrants (NW/NE/SW/SE, represnted by an int)
+// creates a new dummy node from an existing node from one of its quadrants (NW/NE/SW/SE, represnted by an int).
+// The quadrant is taken from the sector of n rather than from its star, which AssignClusterPos moves to the center of mass.
 func (n *Node) NewDummy(i int) *Node {
-	x := n.star.position.x
-	y := n.star.position.y
-	w := n.sector.width / 4
-
-	switch i {
-	case 0:
-		x -= w
-		y += w
-	case 1:
-		x += w
-		y += w
-	case 2:
-		x -= w
-		y -= w
-	case 3:
-		x += w
-		y -= w
-	}
+	sect := n.sector.findNewQuad(i)
 	star := Star{
-		position: OrderedPair{x: x, y: y},
-	}
-	sect := Quadrant{
-		x:     star.position.x - w,
-		y:     star.position.y - w,
-		width: 2 * w,
+		position: OrderedPair{x: sect.x + sect.width/2, y: sect.y + sect.width/2},
 	}
 	return &Node{
+		parent:   n,
 		children: make([]*Node, 4),
 		star:     &star,
 		sector:   sect,
@@ -0,0 +1,611 @@
+/*
+	stores scenario files: a JSON description of a whole run (initial conditions, simulation and rendering
+	parameters, outputs) executed end to end by RunScenario
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"gifhelper"
+	"image"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Scenario is the content of a scenario file, for instance:
+//
+//	{
+//	  "width": 1e23,
+//	  "galaxies": [
+//	    {"stars": 500, "radius": 4e21},
+//	    {"stars": 500, "radius": 4e21}
+//	  ],
+//	  "encounter": {"pericenter": 4e21, "eccentricity": 1, "separation": 1e22, "center": [3.5e22, 3e22]},
+//	  "simulation": {"generations": 10000, "timeStep": 3e15, "theta": 0.5, "integrator": "leapfrog",
+//	                 "softening": {"kind": "plummer", "length": 1e20}},
+//	  "rendering": {"canvasWidth": 1000, "frequency": 1000, "scalingFactor": 1e11},
+//	  "output": {"gif": "collision"}
+//	}
+//
+// Stars come from the galaxies, the explicit bodies and the bodies file, in this order.
+// Without a width, the width of the bodies file is used.
+type Scenario struct {
+	Seed       *int64             `json:"seed"` // seed of the galaxy generators; drawn from the clock and printed when missing
+	Width      float64            `json:"width"`
+	Galaxies   []GalaxyScenario   `json:"galaxies"`
+	Encounter  *EncounterScenario `json:"encounter"`
+	Bodies     []Body             `json:"bodies"`
+	BodiesFile string             `json:"bodiesFile"` // CSV or JSON file read by LoadUniverse, relative to the scenario
+	Simulation SimulationScenario `json:"simulation"`
+	Rendering  RenderingScenario  `json:"rendering"`
+	Output     OutputScenario     `json:"output"`
+
+	source string // file the scenario was read from, for error messages
+	resume string // checkpoint to continue from, if any
+}
+
+// GalaxyScenario describes a galaxy generated by InitializeGalaxy, then transformed and pushed. When it has
+// components, the galaxy is generated by InitializeModelGalaxy instead, and stars and radius are not used.
+type GalaxyScenario struct {
+	Stars  int        `json:"stars"`
+	Radius float64    `json:"radius"`
+	Center [2]float64 `json:"center"`
+	Push   [2]float64 `json:"push"`
+
+	Rotation   float64 `json:"rotation"`   // counterclockwise, in degrees
+	Retrograde bool    `json:"retrograde"` // turn clockwise instead of counterclockwise
+
+	Components    []ComponentScenario `json:"components"`
+	BlackHoleMass float64             `json:"blackHoleMass"`
+
+	// IMF draws the masses, radii and colors of the stars (but not the black hole); all stars are alike when missing
+	IMF struct {
+		Kind    string  `json:"kind"`    // salpeter or kroupa
+		MinMass float64 `json:"minMass"` // in solar masses, 0.1 for salpeter and 0.01 for kroupa when missing
+		MaxMass float64 `json:"maxMass"` // in solar masses, 100 when missing
+	} `json:"imf"`
+}
+
+// EncounterScenario places the first two galaxies on the orbit of an Encounter, before they are pushed.
+// Their masses are those of their stars; inclinations are in degrees.
+type EncounterScenario struct {
+	Pericenter   float64    `json:"pericenter"`
+	Eccentricity float64    `json:"eccentricity"`
+	Separation   float64    `json:"separation"`
+	Center       [2]float64 `json:"center"`
+	Inclinations [2]float64 `json:"inclinations"`
+	Retrograde   [2]bool    `json:"retrograde"`
+}
+
+// ComponentScenario describes a Component; the profile is "exponential", "plummer" or "hernquist".
+type ComponentScenario struct {
+	Profile    string  `json:"profile"`
+	Stars      int     `json:"stars"`
+	Mass       float64 `json:"mass"`
+	Scale      float64 `json:"scale"`
+	Cutoff     float64 `json:"cutoff"`
+	Rotating   bool    `json:"rotating"`
+	Dispersion float64 `json:"dispersion"`
+}
+
+// SimulationScenario holds the parameters turned into Settings; names are those accepted by the Parse functions below.
+type SimulationScenario struct {
+	Generations int      `json:"generations"`
+	TimeStep    float64  `json:"timeStep"`
+	Tolerance   float64  `json:"tolerance"` // adaptive step, with timeStep as the longest step, see Settings.StepSize
+	Theta       *float64 `json:"theta"`     // 0.5 when missing
+	Integrator  string   `json:"integrator"`
+	Multipole   string   `json:"multipole"`
+	Solver      string   `json:"solver"` // barnes-hut when missing
+	Softening   struct {
+		Kind   string  `json:"kind"`
+		Length float64 `json:"length"`
+	} `json:"softening"`
+	MaxDepth    int     `json:"maxDepth"`
+	Coincident  string  `json:"coincident"`
+	MergeRadius float64 `json:"mergeRadius"` // stars closer than this merge under the merge policy, the softening length when 0
+	Boundary    string  `json:"boundary"`
+	Frame       struct {
+		Kind string `json:"kind"`
+		Star int    `json:"star"` // index of the star of the star frame
+	} `json:"frame"`
+	Workers     int  `json:"workers"`
+	FlatTree    bool `json:"flatTree"`    // build a FlatTree instead of a tree of Node pointers
+	MortonOrder bool `json:"mortonOrder"` // build the tree from sorted Morton keys and keep the stars in that order
+	Incremental struct {
+		RebuildEvery    int     `json:"rebuildEvery"`    // updates between two full builds, 0 to build the tree every time
+		RebuildFraction float64 `json:"rebuildFraction"` // fraction of stars changing leaf that also forces a full build
+	} `json:"incremental"`
+	GroupSize int `json:"groupSize"` // stars sharing one interaction list in the tree walk, 0 to walk the tree star by star
+}
+
+// RenderingScenario holds the parameters of AnimateSystem.
+type RenderingScenario struct {
+	CanvasWidth   int     `json:"canvasWidth"`
+	Frequency     int     `json:"frequency"`
+	Interval      float64 `json:"interval"`      // simulated seconds between frames, replacing frequency, see AnimateSystemByTime
+	ScalingFactor float64 `json:"scalingFactor"` // 1 when missing
+}
+
+// OutputScenario names the files written by the run; empty names are skipped.
+type OutputScenario struct {
+	GIF             string `json:"gif"` // without the extension, as for gifhelper.ImagesToGIF
+	PNG             string `json:"png"` // image of the last generation
+	Checkpoint      string `json:"checkpoint"`
+	CheckpointEvery int    `json:"checkpointEvery"` // in generations, a multiple of the rendering frequency; 0 for the last generation only
+
+	Diagnostics      string `json:"diagnostics"`      // CSV time series of energies and momenta
+	DiagnosticsEvery int    `json:"diagnosticsEvery"` // in generations, 1 when missing
+	ExactPotential   bool   `json:"exactPotential"`   // add the O(n^2) exact potential energy to the diagnostics
+}
+
+// ParseIntegrator returns the integrator called name: euler, leapfrog, verlet, rk4 or block (DefaultBlockLeapfrog).
+func ParseIntegrator(name string) (Integrator, error) {
+	switch strings.ToLower(name) {
+	case "euler":
+		return Euler{}, nil
+	case "leapfrog":
+		return Leapfrog{}, nil
+	case "verlet":
+		return VelocityVerlet{}, nil
+	case "rk4":
+		return RK4{}, nil
+	case "block":
+		return DefaultBlockLeapfrog, nil
+	}
+	return nil, fmt.Errorf("unknown integrator %q, expected euler, leapfrog, verlet, rk4 or block", name)
+}
+
+// ParseMultipoleOrder returns the multipole order called name: monopole or quadrupole.
+func ParseMultipoleOrder(name string) (MultipoleOrder, error) {
+	switch strings.ToLower(name) {
+	case "monopole":
+		return MonopoleOrder, nil
+	case "quadrupole":
+		return QuadrupoleOrder, nil
+	}
+	return MonopoleOrder, fmt.Errorf("unknown multipole order %q, expected monopole or quadrupole", name)
+}
+
+// ParseForceSolver returns the force solver called name: barnes-hut or fmm.
+func ParseForceSolver(name string) (ForceSolver, error) {
+	switch strings.ToLower(name) {
+	case "barnes-hut":
+		return BarnesHutSolver, nil
+	case "fmm":
+		return FMMSolver, nil
+	}
+	return BarnesHutSolver, fmt.Errorf("unknown force solver %q, expected barnes-hut or fmm", name)
+}
+
+// ParseSofteningKind returns the softening kernel called name: none, plummer or spline.
+func ParseSofteningKind(name string) (SofteningKind, error) {
+	switch strings.ToLower(name) {
+	case "none":
+		return NoSoftening, nil
+	case "plummer":
+		return PlummerSoftening, nil
+	case "spline":
+		return SplineSoftening, nil
+	}
+	return NoSoftening, fmt.Errorf("unknown softening %q, expected none, plummer or spline", name)
+}
+
+// ParseCoincidentPolicy returns the coincident policy called name: bucket, merge or error.
+func ParseCoincidentPolicy(name string) (CoincidentPolicy, error) {
+	switch strings.ToLower(name) {
+	case "bucket":
+		return BucketCoincident, nil
+	case "merge":
+		return MergeCoincident, nil
+	case "error":
+		return ErrorCoincident, nil
+	}
+	return BucketCoincident, fmt.Errorf("unknown coincident policy %q, expected bucket, merge or error", name)
+}
+
+// ParseBoundaryPolicy returns the boundary policy called name: open, drop, reflect or wrap.
+func ParseBoundaryPolicy(name string) (BoundaryPolicy, error) {
+	switch strings.ToLower(name) {
+	case "open":
+		return OpenBoundary, nil
+	case "drop":
+		return DropBoundary, nil
+	case "reflect":
+		return ReflectBoundary, nil
+	case "wrap":
+		return WrapBoundary, nil
+	}
+	return OpenBoundary, fmt.Errorf("unknown boundary policy %q, expected open, drop, reflect or wrap", name)
+}
+
+// ParseFrameKind returns the frame kind called name: fixed, center-of-mass or star.
+func ParseFrameKind(name string) (FrameKind, error) {
+	switch strings.ToLower(name) {
+	case "fixed":
+		return FixedFrame, nil
+	case "center-of-mass":
+		return CenterOfMassFrame, nil
+	case "star":
+		return StarFrame, nil
+	}
+	return FixedFrame, fmt.Errorf("unknown frame %q, expected fixed, center-of-mass or star", name)
+}
+
+// LoadScenario reads the scenario file at path. A relative bodies file is resolved against the directory of path.
+func LoadScenario(path string) (*Scenario, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var scenario Scenario
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&scenario); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if scenario.BodiesFile != "" && !filepath.IsAbs(scenario.BodiesFile) {
+		scenario.BodiesFile = filepath.Join(filepath.Dir(path), scenario.BodiesFile)
+	}
+	scenario.source = path
+	return &scenario, nil
+}
+
+// Universe builds the initial universe of the scenario.
+// The same scenario with the same seed always gives the same universe, which records the seed.
+func (scenario *Scenario) Universe() (*Universe, error) {
+	seeded := scenario.Seed != nil
+	var seed int64
+	if seeded {
+		seed = *scenario.Seed
+	} else if len(scenario.Galaxies) > 0 {
+		seed = time.Now().UnixNano()
+		seeded = true
+		fmt.Println("Generating galaxies with seed", seed)
+	}
+	rng := NewRand(seed)
+
+	galaxies := make([]Galaxy, len(scenario.Galaxies))
+	for i := range scenario.Galaxies {
+		galaxy, err := scenario.Galaxies[i].Galaxy(rng)
+		if err != nil {
+			return nil, fmt.Errorf("galaxies[%d]: %v", i, err)
+		}
+		galaxies[i] = galaxy
+	}
+	if scenario.Encounter != nil {
+		if len(galaxies) < 2 {
+			return nil, fmt.Errorf("encounter: needs two galaxies")
+		}
+		if err := scenario.Encounter.Setup(galaxies[0], galaxies[1]); err != nil {
+			return nil, err
+		}
+	}
+
+	var stars []*Star
+	for i, g := range scenario.Galaxies {
+		push(&galaxies[i], OrderedPair{g.Push[0], g.Push[1]})
+		stars = append(stars, galaxies[i]...)
+	}
+
+	for i, body := range scenario.Bodies {
+		s, err := body.Star()
+		if err != nil {
+			return nil, fmt.Errorf("bodies[%d]: %v", i, err)
+		}
+		stars = append(stars, &s)
+	}
+
+	width := scenario.Width
+	if scenario.BodiesFile != "" {
+		u, err := LoadUniverse(scenario.BodiesFile)
+		if err != nil {
+			return nil, err
+		}
+		stars = append(stars, u.stars...)
+		if width == 0 {
+			width = u.width
+		}
+	}
+
+	if len(stars) == 0 {
+		return nil, fmt.Errorf("no galaxies or bodies")
+	}
+	if !(width > 0) {
+		return nil, fmt.Errorf("width must be positive, got %g", width)
+	}
+	return &Universe{stars: stars, width: width, seed: seed, seeded: seeded}, nil
+}
+
+// Setup places g1 and g2 as described by e, see SetupEncounter.
+func (e *EncounterScenario) Setup(g1, g2 Galaxy) error {
+	return SetupEncounter(g1, g2, Encounter{
+		mass1:        g1.Mass(),
+		mass2:        g2.Mass(),
+		pericenter:   e.Pericenter,
+		eccentricity: e.Eccentricity,
+		separation:   e.Separation,
+		center:       OrderedPair{e.Center[0], e.Center[1]},
+		inclination1: e.Inclinations[0] * math.Pi / 180,
+		inclination2: e.Inclinations[1] * math.Pi / 180,
+		retrograde1:  e.Retrograde[0],
+		retrograde2:  e.Retrograde[1],
+	})
+}
+
+// ParseIMF returns the initial mass function called name, salpeter or kroupa, between minMass and maxMass
+// (in solar masses); zero bounds take the defaults described in GalaxyScenario.
+func ParseIMF(name string, minMass, maxMass float64) (IMF, error) {
+	if maxMass == 0 {
+		maxMass = 100
+	}
+	switch strings.ToLower(name) {
+	case "salpeter":
+		if minMass == 0 {
+			minMass = 0.1
+		}
+		if !(minMass > 0 && minMass < maxMass) {
+			return nil, fmt.Errorf("imf masses must satisfy 0 < minMass < maxMass")
+		}
+		return Salpeter{minMass, maxMass}, nil
+	case "kroupa":
+		if minMass == 0 {
+			minMass = 0.01
+		}
+		if !(minMass > 0 && minMass < maxMass) {
+			return nil, fmt.Errorf("imf masses must satisfy 0 < minMass < maxMass")
+		}
+		return Kroupa{minMass, maxMass}, nil
+	}
+	return nil, fmt.Errorf("unknown imf %q, expected salpeter or kroupa", name)
+}
+
+// Galaxy generates the galaxy described by g, before it is pushed.
+func (g *GalaxyScenario) Galaxy(rng *rand.Rand) (Galaxy, error) {
+	galaxy, err := g.generate(rng)
+	if err != nil {
+		return nil, err
+	}
+
+	if g.IMF.Kind != "" {
+		imf, err := ParseIMF(g.IMF.Kind, g.IMF.MinMass, g.IMF.MaxMass)
+		if err != nil {
+			return nil, err
+		}
+		// InitializeGalaxy always ends with a black hole, InitializeModelGalaxy only when it has a mass. The stars of
+		// a model galaxy keep their total mass, so the galaxy stays in equilibrium.
+		stars := galaxy
+		if len(g.Components) == 0 || g.BlackHoleMass > 0 {
+			stars = galaxy[:len(galaxy)-1]
+		}
+		AssignStellarMasses(rng, stars, imf, len(g.Components) > 0)
+	}
+
+	if g.Retrograde {
+		galaxy.FlipSpin()
+	}
+	galaxy.Rotate(g.Rotation * math.Pi / 180)
+	return galaxy, nil
+}
+
+func (g *GalaxyScenario) generate(rng *rand.Rand) (Galaxy, error) {
+	if len(g.Components) == 0 {
+		if g.Stars <= 0 || !(g.Radius > 0) {
+			return nil, fmt.Errorf("a galaxy needs a positive number of stars and radius")
+		}
+		return InitializeGalaxy(rng, g.Stars, g.Radius, g.Center[0], g.Center[1]), nil
+	}
+
+	components := make([]Component, len(g.Components))
+	for i, c := range g.Components {
+		var profile Profile
+		switch strings.ToLower(c.Profile) {
+		case "exponential":
+			profile = ExponentialDisk{c.Mass, c.Scale}
+		case "plummer":
+			profile = PlummerSphere{c.Mass, c.Scale}
+		case "hernquist":
+			profile = HernquistSphere{c.Mass, c.Scale}
+		default:
+			return nil, fmt.Errorf("components[%d]: unknown profile %q, expected exponential, plummer or hernquist", i, c.Profile)
+		}
+		if !(c.Scale > 0) {
+			return nil, fmt.Errorf("components[%d]: scale must be positive", i)
+		}
+		components[i] = Component{
+			profile:    profile,
+			numStars:   c.Stars,
+			cutoff:     c.Cutoff,
+			rotating:   c.Rotating,
+			dispersion: c.Dispersion,
+		}
+	}
+	return InitializeModelGalaxy(rng, components, g.BlackHoleMass, g.Center[0], g.Center[1])
+}
+
+// Settings converts the simulation parameters of the scenario.
+func (scenario *Scenario) Settings() (*Settings, error) {
+	sim := scenario.Simulation
+	if sim.Generations <= 0 || !(sim.TimeStep > 0) {
+		return nil, fmt.Errorf("simulation: generations and timeStep must be positive")
+	}
+
+	theta := 0.5
+	if sim.Theta != nil {
+		theta = *sim.Theta
+	}
+	settings := DefaultSettings(sim.TimeStep, theta)
+	settings.tolerance = sim.Tolerance
+
+	var err error
+	if sim.Integrator != "" {
+		if settings.integrator, err = ParseIntegrator(sim.Integrator); err != nil {
+			return nil, err
+		}
+	}
+	if sim.Solver != "" {
+		if settings.solver, err = ParseForceSolver(sim.Solver); err != nil {
+			return nil, err
+		}
+	}
+	if sim.Multipole != "" {
+		if settings.multipole, err = ParseMultipoleOrder(sim.Multipole); err != nil {
+			return nil, err
+		}
+	}
+	if sim.Softening.Kind != "" {
+		if settings.softening.kind, err = ParseSofteningKind(sim.Softening.Kind); err != nil {
+			return nil, err
+		}
+		settings.softening.epsilon = sim.Softening.Length
+	}
+	if sim.Coincident != "" {
+		if settings.coincident, err = ParseCoincidentPolicy(sim.Coincident); err != nil {
+			return nil, err
+		}
+	}
+	if !(sim.MergeRadius >= 0) {
+		return nil, fmt.Errorf("simulation: mergeRadius must not be negative, got %g", sim.MergeRadius)
+	}
+	settings.mergeRadius = sim.MergeRadius
+	if sim.Boundary != "" {
+		if settings.boundary, err = ParseBoundaryPolicy(sim.Boundary); err != nil {
+			return nil, err
+		}
+	}
+	if sim.Frame.Kind != "" {
+		if settings.frame.kind, err = ParseFrameKind(sim.Frame.Kind); err != nil {
+			return nil, err
+		}
+		settings.frame.star = sim.Frame.Star
+	}
+	if sim.MaxDepth > 0 {
+		settings.maxDepth = sim.MaxDepth
+	}
+	if sim.Workers > 0 {
+		settings.workers = sim.Workers
+	}
+	settings.flatTree = sim.FlatTree
+	settings.mortonOrder = sim.MortonOrder
+	settings.rebuildEvery = sim.Incremental.RebuildEvery
+	settings.rebuildFraction = sim.Incremental.RebuildFraction
+	settings.groupSize = sim.GroupSize
+	if err := checkTreeOptions(settings); err != nil {
+		return nil, fmt.Errorf("simulation: %v", err)
+	}
+	return settings, nil
+}
+
+// RunScenario loads the scenario file at path, runs it and writes its outputs.
+func RunScenario(path string) error {
+	scenario, err := LoadScenario(path)
+	if err != nil {
+		return err
+	}
+	return scenario.Run()
+}
+
+// Run runs the scenario and writes its outputs. If the scenario has a checkpoint to resume from,
+// the run continues from that checkpoint instead of starting from the initial conditions.
+func (scenario *Scenario) Run() error {
+	settings, err := scenario.Settings()
+	if err != nil {
+		return fmt.Errorf("%s: %v", scenario.source, err)
+	}
+
+	render := scenario.Rendering
+	if render.CanvasWidth <= 0 || (render.Frequency <= 0 && !(render.Interval > 0)) {
+		return fmt.Errorf("%s: rendering: canvasWidth and frequency or interval must be positive", scenario.source)
+	}
+	if render.ScalingFactor == 0 {
+		render.ScalingFactor = 1
+	}
+
+	var diagnostics *os.File
+	var w *bufio.Writer
+	if scenario.Output.Diagnostics != "" {
+		diagnostics, err = os.Create(scenario.Output.Diagnostics)
+		if err != nil {
+			return err
+		}
+		defer diagnostics.Close()
+		w = bufio.NewWriter(diagnostics)
+
+		settings.diagnostics = w
+		settings.diagnosticsEvery = scenario.Output.DiagnosticsEvery
+		if settings.diagnosticsEvery == 0 {
+			settings.diagnosticsEvery = 1
+		}
+		settings.exactPotential = scenario.Output.ExactPotential
+	}
+
+	var images []image.Image
+	stride := render.Frequency
+	emit := AnimateStream(&images, render.CanvasWidth, render.ScalingFactor)
+	if render.Interval > 0 {
+		// frames follow the simulated time, so every generation has to be seen
+		stride = 1
+		emit = AnimateStreamByTime(&images, render.CanvasWidth, render.Interval, render.ScalingFactor)
+	}
+	if scenario.Output.Checkpoint != "" && scenario.Output.CheckpointEvery > 0 {
+		// checkpoints are written from the generations passed to emit, so any other generation would be skipped
+		if scenario.Output.CheckpointEvery%stride != 0 {
+			return fmt.Errorf("%s: output: checkpointEvery (%d) must be a multiple of the rendering frequency (%d)",
+				scenario.source, scenario.Output.CheckpointEvery, stride)
+		}
+		emit = CheckpointEvery(scenario.Output.Checkpoint, scenario.Output.CheckpointEvery, settings, emit)
+	}
+
+	var final *Universe
+	if scenario.resume != "" {
+		fmt.Println("Resuming", scenario.source, "from", scenario.resume+".")
+		final, err = ResumeUniverse(scenario.resume, scenario.Simulation.Generations, stride, settings, emit)
+	} else {
+		var u *Universe
+		u, err = scenario.Universe()
+		if err != nil {
+			return fmt.Errorf("%s: %v", scenario.source, err)
+		}
+		fmt.Println("Running", scenario.source, "with", len(u.stars), "stars.")
+		final, err = EvolveUniverse(u, scenario.Simulation.Generations, stride, settings, emit)
+	}
+	if err != nil {
+		return err
+	}
+	if diagnostics != nil {
+		// the diagnostics are only complete once the buffer reaches the disk
+		if err := w.Flush(); err != nil {
+			return fmt.Errorf("%s: %v", scenario.Output.Diagnostics, err)
+		}
+		if err := diagnostics.Close(); err != nil {
+			return fmt.Errorf("%s: %v", scenario.Output.Diagnostics, err)
+		}
+	}
+
+	if scenario.Output.Checkpoint != "" && scenario.Output.CheckpointEvery <= 0 {
+		// without an interval, the checkpoint holds the end of the run, to be continued later
+		if err := WriteCheckpoint(scenario.Output.Checkpoint, final, scenario.Simulation.Generations, settings); err != nil {
+			return err
+		}
+	}
+	if scenario.Output.GIF != "" {
+		gifhelper.ImagesToGIF(images, scenario.Output.GIF)
+		fmt.Println("GIF drawn.")
+	}
+	if scenario.Output.PNG != "" {
+		if err := SaveUniverseToPNG(final, scenario.Output.PNG, render.CanvasWidth, render.ScalingFactor); err != nil {
+			return err
+		}
+	}
+	fmt.Println("Simulation run and images drawn.")
+	return nil
+}
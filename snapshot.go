@@ -0,0 +1,264 @@
+/*
+	stores the on-disk snapshot format, used to checkpoint a run and resume it later
+
+	All values are little endian. A snapshot is a header followed by one record per star:
+		header: magic "BHSN", version (uint16), generation (int64), time step, theta, width (float64),
+		        escaped stars (int64), seeded (uint8, 0 or 1), seed (int64), simulated time (float64),
+		        followed star (int64, -1 for none), number of stars (uint64)
+		star:   position x, y, velocity x, y, acceleration x, y, mass, radius (float64), red, green, blue (uint8)
+	Version 1 snapshots, which have no seed fields, and version 2 snapshots, which have no simulated time, can
+	still be read; their simulated time is taken to be the generation times the time step. Versions up to 3
+	have no followed star: a star frame resumed from them follows the star at the index of the frame.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const snapshotMagic = "BHSN"
+
+// snapshotVersion is bumped whenever the layout above changes
+const snapshotVersion uint16 = 4
+
+// Snapshot is a universe together with what is needed to keep evolving it exactly as before.
+type Snapshot struct {
+	version    uint16
+	generation int
+	time       float64 // length of a time step, the longest one with an adaptive step
+	theta      float64
+	universe   *Universe
+}
+
+// WriteSnapshot writes u, reached at the given generation with the time step and theta of settings, to w.
+func WriteSnapshot(w io.Writer, u *Universe, generation int, settings *Settings) error {
+	bw := bufio.NewWriter(w)
+	sw := snapshotWriter{w: bw}
+
+	sw.write([]byte(snapshotMagic))
+	sw.write(snapshotVersion)
+	sw.write(int64(generation))
+	sw.write([]float64{settings.time, settings.theta, u.width})
+	sw.write(int64(u.escaped))
+	var seeded uint8
+	if u.seeded {
+		seeded = 1
+	}
+	sw.write(seeded)
+	sw.write(u.seed)
+	sw.write(u.time)
+	followed := int64(-1)
+	for i, s := range u.stars {
+		if s == u.followed {
+			followed = int64(i)
+		}
+	}
+	sw.write(followed)
+	sw.write(uint64(len(u.stars)))
+	for _, s := range u.stars {
+		sw.write([]float64{
+			s.position.x, s.position.y,
+			s.velocity.x, s.velocity.y,
+			s.acceleration.x, s.acceleration.y,
+			s.mass, s.radius,
+		})
+		sw.write([]uint8{s.red, s.green, s.blue})
+	}
+
+	if sw.err != nil {
+		return sw.err
+	}
+	return bw.Flush()
+}
+
+// ReadSnapshot reads a snapshot written by WriteSnapshot from r.
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	sr := snapshotReader{r: bufio.NewReader(r)}
+
+	magic := make([]byte, len(snapshotMagic))
+	sr.read(magic)
+	var version uint16
+	sr.read(&version)
+	if sr.err != nil {
+		return nil, fmt.Errorf("snapshot: reading header: %v", sr.err)
+	}
+	if string(magic) != snapshotMagic {
+		return nil, errors.New("snapshot: not a snapshot file")
+	}
+	if version < 1 || version > snapshotVersion {
+		return nil, fmt.Errorf("snapshot: unsupported version %d (expected at most %d)", version, snapshotVersion)
+	}
+
+	var generation, escaped, seed int64
+	followed := int64(-1)
+	var seeded uint8
+	var elapsed float64
+	var numStars uint64
+	params := make([]float64, 3)
+	sr.read(&generation)
+	sr.read(params)
+	sr.read(&escaped)
+	if version >= 2 {
+		sr.read(&seeded)
+		sr.read(&seed)
+	}
+	if version >= 3 {
+		sr.read(&elapsed)
+	} else {
+		elapsed = float64(generation) * params[0]
+	}
+	if version >= 4 {
+		sr.read(&followed)
+	}
+	sr.read(&numStars)
+	if sr.err != nil {
+		return nil, fmt.Errorf("snapshot: reading header: %v", sr.err)
+	}
+
+	u := &Universe{
+		width:   params[2],
+		escaped: int(escaped),
+		seed:    seed,
+		seeded:  seeded != 0,
+		time:    elapsed,
+	}
+	values := make([]float64, 8)
+	colors := make([]uint8, 3)
+	for i := uint64(0); i < numStars; i++ {
+		sr.read(values)
+		sr.read(colors)
+		if sr.err != nil {
+			return nil, fmt.Errorf("snapshot: reading star %d of %d: %v", i, numStars, sr.err)
+		}
+		u.AddStar(Star{
+			position:     OrderedPair{values[0], values[1]},
+			velocity:     OrderedPair{values[2], values[3]},
+			acceleration: OrderedPair{values[4], values[5]},
+			mass:         values[6],
+			radius:       values[7],
+			red:          colors[0],
+			green:        colors[1],
+			blue:         colors[2],
+		})
+	}
+	if followed >= 0 {
+		if followed >= int64(len(u.stars)) {
+			return nil, fmt.Errorf("snapshot: followed star %d out of range, the universe has %d stars", followed, len(u.stars))
+		}
+		u.followed = u.stars[followed]
+	}
+
+	return &Snapshot{
+		version:    version,
+		generation: int(generation),
+		time:       params[0],
+		theta:      params[1],
+		universe:   u,
+	}, nil
+}
+
+// WriteCheckpoint saves u as a snapshot file at path. The file is written next to path and renamed,
+// so a crash while writing never leaves a truncated checkpoint behind.
+func WriteCheckpoint(path string, u *Universe, generation int, settings *Settings) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := WriteSnapshot(f, u, generation, settings); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// ReadCheckpoint loads the snapshot file at path.
+func ReadCheckpoint(path string) (*Snapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadSnapshot(f)
+}
+
+// CheckpointEvery wraps emit so that every universe it receives at a multiple of every generations
+// is also saved to path. Only the generations emitted by EvolveUniverse are seen, so every should be a multiple of the stride.
+// The incremental tree of settings is reset at every checkpoint, as it is when resuming from one.
+func CheckpointEvery(path string, every int, settings *Settings, emit SnapshotFunc) SnapshotFunc {
+	return func(generation int, u *Universe) error {
+		if generation%every == 0 {
+			if err := WriteCheckpoint(path, u, generation, settings); err != nil {
+				return err
+			}
+			if settings.incremental != nil {
+				settings.incremental.Reset()
+			}
+		}
+		return emit(generation, u)
+	}
+}
+
+// ResumeUniverse continues a run from the checkpoint at path up to generation numGens, like EvolveUniverse.
+// The time step and theta are taken from the checkpoint, everything else from settings. With the same
+// settings as the original run, the universes produced are identical to those of an uninterrupted run
+// that wrote the checkpoint with CheckpointEvery: the incremental tree, which the checkpoint does not
+// hold, is built from scratch after the checkpoint in both runs.
+func ResumeUniverse(path string, numGens, stride int, settings *Settings, emit SnapshotFunc) (*Universe, error) {
+	if stride < 1 {
+		return nil, fmt.Errorf("snapshot stride must be positive, got %d", stride)
+	}
+	snapshot, err := ReadCheckpoint(path)
+	if err != nil {
+		return nil, err
+	}
+
+	resumed := *settings
+	resumed.time = snapshot.time
+	resumed.theta = snapshot.theta
+	if resumed.incremental != nil {
+		resumed.incremental.Reset()
+	}
+
+	if snapshot.version < 4 {
+		if err := FollowStar(snapshot.universe, resumed.frame); err != nil {
+			return nil, err
+		}
+	}
+
+	// the stored accelerations are exactly those of the interrupted run, so the integrator is not restarted
+	return continueUniverse(snapshot.universe, snapshot.generation, numGens, stride, &resumed, emit)
+}
+
+// snapshotWriter writes binary values, remembering the first error so that it is checked only once.
+type snapshotWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (sw *snapshotWriter) write(v interface{}) {
+	if sw.err == nil {
+		sw.err = binary.Write(sw.w, binary.LittleEndian, v)
+	}
+}
+
+// snapshotReader is the reading counterpart of snapshotWriter.
+type snapshotReader struct {
+	r   io.Reader
+	err error
+}
+
+func (sr *snapshotReader) read(v interface{}) {
+	if sr.err == nil {
+		sr.err = binary.Read(sr.r, binary.LittleEndian, v)
+	}
+}
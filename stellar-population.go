@@ -0,0 +1,149 @@
+/*
+	stores stellar populations: star masses drawn from an initial mass function, with radius and
+	color following from the mass of each star
+*/
+
+package main
+
+import (
+	"math"
+	"math/rand"
+)
+
+const solarRadius = 696340000 // radius of sun in m
+
+const solarTemperature = 5772 // effective temperature of sun in K
+
+// IMF is an initial mass function: the distribution of the masses of newly formed stars.
+type IMF interface {
+	// Sample draws a star mass, in solar masses
+	Sample(rng *rand.Rand) float64
+}
+
+// Salpeter is the power law dN/dm ~ m^-2.35 between minMass and maxMass (in solar masses).
+type Salpeter struct {
+	minMass, maxMass float64
+}
+
+// Kroupa is the broken power law of Kroupa (2001) between minMass and maxMass (in solar masses):
+// dN/dm ~ m^-0.3 below 0.08, m^-1.3 between 0.08 and 0.5 and m^-2.3 above 0.5.
+type Kroupa struct {
+	minMass, maxMass float64
+}
+
+func (imf Salpeter) Sample(rng *rand.Rand) float64 {
+	return samplePowerLaw(rng, 2.35, imf.minMass, imf.maxMass)
+}
+
+func (imf Kroupa) Sample(rng *rand.Rand) float64 {
+	breaks := []float64{0, 0.08, 0.5, math.Inf(1)}
+	slopes := []float64{0.3, 1.3, 2.3}
+
+	// weight of each segment within [minMass, maxMass]; the factor k keeps dN/dm continuous at the breaks
+	var lo, hi [3]float64
+	var weights [3]float64
+	var total float64
+	k := 1.0
+	for i := range slopes {
+		if i > 0 {
+			k *= math.Pow(breaks[i], slopes[i]-slopes[i-1])
+		}
+		lo[i] = math.Max(imf.minMass, breaks[i])
+		hi[i] = math.Min(imf.maxMass, breaks[i+1])
+		if lo[i] < hi[i] {
+			weights[i] = k * powerLawIntegral(slopes[i], lo[i], hi[i])
+			total += weights[i]
+		}
+	}
+
+	x := rng.Float64() * total
+	for i := range slopes {
+		if x < weights[i] || i == len(slopes)-1 {
+			return samplePowerLaw(rng, slopes[i], lo[i], hi[i])
+		}
+		x -= weights[i]
+	}
+	return imf.maxMass
+}
+
+// powerLawIntegral integrates m^-alpha between a and b
+func powerLawIntegral(alpha, a, b float64) float64 {
+	if alpha == 1 {
+		return math.Log(b / a)
+	}
+	return (math.Pow(b, 1-alpha) - math.Pow(a, 1-alpha)) / (1 - alpha)
+}
+
+// samplePowerLaw draws m between a and b with a probability density proportional to m^-alpha, by inverting its distribution
+func samplePowerLaw(rng *rand.Rand, alpha, a, b float64) float64 {
+	u := rng.Float64()
+	if alpha == 1 {
+		return a * math.Pow(b/a, u)
+	}
+	e := 1 - alpha
+	return math.Pow(math.Pow(a, e)+u*(math.Pow(b, e)-math.Pow(a, e)), 1/e)
+}
+
+// MainSequenceRadius is the radius in meters of a main sequence star of mass m (in solar masses).
+func MainSequenceRadius(m float64) float64 {
+	if m < 1 {
+		return solarRadius * math.Pow(m, 0.8)
+	}
+	return solarRadius * math.Pow(m, 0.57)
+}
+
+// MainSequenceTemperature is the effective temperature in K of a main sequence star of mass m (in solar masses),
+// from its luminosity L ~ m^3.5 and radius through L ~ R^2 T^4.
+func MainSequenceTemperature(m float64) float64 {
+	r := MainSequenceRadius(m) / solarRadius
+	return solarTemperature * math.Pow(math.Pow(m, 3.5)/(r*r), 0.25)
+}
+
+// BlackbodyColor approximates the color of a black body at temperature T (in K), using
+// Tanner Helland's fit of the CIE color matching functions.
+func BlackbodyColor(T float64) (uint8, uint8, uint8) {
+	t := T / 100
+	var r, g, b float64
+	if t <= 66 {
+		r = 255
+		g = 99.4708025861*math.Log(t) - 161.1195681661
+	} else {
+		r = 329.698727446 * math.Pow(t-60, -0.1332047592)
+		g = 288.1221695283 * math.Pow(t-60, -0.0755148492)
+	}
+	if t >= 66 {
+		b = 255
+	} else if t <= 19 {
+		b = 0
+	} else {
+		b = 138.5177312231*math.Log(t-10) - 305.0447927307
+	}
+	return clampColor(r), clampColor(g), clampColor(b)
+}
+
+func clampColor(c float64) uint8 {
+	return uint8(math.Round(math.Min(math.Max(c, 0), 255)))
+}
+
+// AssignStellarMasses draws the mass of every star of stars from imf, and sets its radius and color to those
+// of a main sequence star of that mass. Leave black holes out, for instance with g[:len(g)-1] for a galaxy
+// from InitializeGalaxy. If preserveTotal is true the masses are rescaled to keep the total mass of stars,
+// as needed for the stars of InitializeModelGalaxy, which each stand for many real stars; radii and colors
+// still follow the drawn masses.
+func AssignStellarMasses(rng *rand.Rand, stars []*Star, imf IMF, preserveTotal bool) {
+	var before, after float64
+	for _, s := range stars {
+		m := imf.Sample(rng)
+		before += s.mass
+		s.mass = m * solarMass
+		after += s.mass
+		s.radius = MainSequenceRadius(m)
+		s.red, s.green, s.blue = BlackbodyColor(MainSequenceTemperature(m))
+	}
+
+	if preserveTotal && after > 0 {
+		for _, s := range stars {
+			s.mass *= before / after
+		}
+	}
+}